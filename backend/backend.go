@@ -2,14 +2,47 @@ package backend
 
 import (
 	"context"
+	"github.com/atlassian/go-sentry-api"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/time/rate"
+	"net/http"
+	"sync"
 )
 
 const SecretTypeCreds = "creds"
 
 type backend struct {
 	*framework.Backend
+
+	// tidyRunning is set while a tidy operation is in progress
+	tidyRunning uint32
+
+	// revalidating holds the DSNs that are being revalidated in the background
+	revalidating sync.Map
+
+	// background is the context of work that outlives a request. It is
+	// cancelled when the mount is unmounted.
+	background       context.Context
+	cancelBackground context.CancelFunc
+
+	// dsnLocks serialize sentry lookups and creation of DSN labels
+	dsnLocks []*locksutil.LockEntry
+
+	// projectLocks serialize writes of project configurations
+	projectLocks []*locksutil.LockEntry
+
+	// integrationLocks serialize writes and token rotations of integrations
+	integrationLocks []*locksutil.LockEntry
+
+	// sentryClient is built from clientConfig and reused across requests
+	sentryClient *sentry.Client
+	clientConfig SentryOrg
+	transport    *http.Transport
+	limiter      *rate.Limiter
+	clientLock   sync.Mutex
 }
 
 func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, error) {
@@ -24,11 +57,26 @@ func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, er
 
 func New(c *logical.BackendConfig) *backend {
 	b := new(backend)
+	b.dsnLocks = locksutil.CreateLocks()
+	b.projectLocks = locksutil.CreateLocks()
+	b.integrationLocks = locksutil.CreateLocks()
+	b.background, b.cancelBackground = context.WithCancel(context.Background())
 
 	b.Backend = &framework.Backend{
-		BackendType: logical.TypeLogical,
+		BackendType:    logical.TypeLogical,
+		InitializeFunc: b.initialize,
+		PeriodicFunc:   b.periodicFunc,
+		Invalidate:     b.invalidate,
+		Clean:          b.clean,
 		PathsSpecial: &logical.Paths{
 			Unauthenticated: []string{"info"},
+			// config is listed for configurations that still
+			// hold the token inline from before it was split out
+			SealWrapStorage: []string{
+				KeyConfig,
+				KeyConfigToken,
+				KeyIntegrationTokenPrefix,
+			},
 		},
 		Paths: []*framework.Path{
 			{
@@ -44,13 +92,11 @@ func New(c *logical.BackendConfig) *backend {
 				Fields: map[string]*framework.FieldSchema{
 					"org": {
 						Type:        framework.TypeString,
-						Required:    true,
-						Description: "Slug of the sentry organization",
+						Description: "Slug of the sentry organization. Required when the plugin is configured for the first time",
 					},
 					"token": {
 						Type:        framework.TypeString,
-						Required:    true,
-						Description: "Sentry API token",
+						Description: "Sentry API token. Required when the plugin is configured for the first time",
 					},
 					"endpoint": {
 						Type:        framework.TypeString,
@@ -62,13 +108,289 @@ func New(c *logical.BackendConfig) *backend {
 						Default:     10,
 						Description: "Connection timeout for API requests",
 					},
+					"dsn_auto_create": {
+						Type:        framework.TypeBool,
+						Default:     false,
+						Description: "Create missing DSN labels in sentry when they are read. Projects can override this",
+					},
+					"max_dsn_labels": {
+						Type:        framework.TypeInt,
+						Default:     0,
+						Description: "Maximum number of DSN labels per project, 0 means unlimited. Projects can override this",
+					},
+					"dsn_cache_ttl": {
+						Type:        framework.TypeDurationSecond,
+						Default:     0,
+						Description: "Age after which cached DSNs are revalidated against sentry, 0 disables revalidation",
+					},
+					"dsn_stale_if_error": {
+						Type:        framework.TypeDurationSecond,
+						Default:     defaultDsnStaleIfError,
+						Description: "Period after dsn_cache_ttl during which a cached DSN is served while it is revalidated in the background",
+					},
+					"rate_limit": {
+						Type:        framework.TypeInt,
+						Default:     defaultRateLimit,
+						Description: "Maximum number of sentry API requests per second made by this mount, 0 disables the limit",
+					},
+					"rate_limit_burst": {
+						Type:        framework.TypeInt,
+						Default:     defaultRateLimitBurst,
+						Description: "Number of sentry API requests that may exceed rate_limit in a burst",
+					},
+					"max_retries": {
+						Type:        framework.TypeInt,
+						Default:     defaultMaxRetries,
+						Description: "Maximum number of retries of sentry API requests that are rate limited or fail with a server error",
+					},
+					"operation_timeout": {
+						Type:        framework.TypeDurationSecond,
+						Default:     defaultOperationTimeout,
+						Description: "Deadline for all sentry API requests made by a single operation, 0 disables it",
+					},
+					"ca_cert": {
+						Type:        framework.TypeString,
+						Description: "PEM encoded CA bundle used to verify the certificate of the sentry endpoint. The system roots are used when empty",
+					},
+					"client_cert": {
+						Type:        framework.TypeString,
+						Description: "PEM encoded client certificate presented to the sentry endpoint",
+					},
+					"client_key": {
+						Type:        framework.TypeString,
+						Description: "PEM encoded key of the client certificate",
+					},
+					"proxy_url": {
+						Type:        framework.TypeString,
+						Description: "URL of the HTTP(S) proxy used for sentry API requests, without credentials. The proxy environment variables are used when empty",
+					},
+					"tls_min_version": {
+						Type:        framework.TypeString,
+						Default:     "tls12",
+						Description: "Minimum TLS version for connections to the sentry endpoint. One of tls10, tls11, tls12 or tls13",
+					},
+					"allow_missing_scopes": {
+						Type:        framework.TypeBool,
+						Default:     false,
+						Description: "Accept a token that lacks the scopes needed for managing projects and their DSN",
+					},
+					"force": {
+						Type:        framework.TypeBool,
+						Default:     false,
+						Description: "Remove the configuration on delete even though projects are still configured",
+					},
 				},
+				ExistenceCheck: handleConfigExistenceCheck,
 				Operations: map[logical.Operation]framework.OperationHandler{
 					logical.ReadOperation: &framework.PathOperation{
 						Callback: handleConfigRead,
 					},
+					logical.CreateOperation: &framework.PathOperation{
+						Callback: b.handleConfigUpdate,
+					},
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.handleConfigUpdate,
+					},
+					logical.DeleteOperation: &framework.PathOperation{
+						Callback: b.handleConfigDelete,
+					},
+				},
+			},
+			{
+				Pattern: "config/privacy$",
+				Fields: map[string]*framework.FieldSchema{
+					"data_scrubber": {
+						Type:        framework.TypeBool,
+						Required:    false,
+						Description: "Enable server-side data scrubbing",
+					},
+					"data_scrubber_defaults": {
+						Type:        framework.TypeBool,
+						Required:    false,
+						Description: "Apply the default scrubbers to prevent passwords and credit cards from being stored",
+					},
+					"scrub_ip_addresses": {
+						Type:        framework.TypeBool,
+						Required:    false,
+						Description: "Prevent IP addresses from being stored for new events",
+					},
+					"sensitive_fields": {
+						Type:        framework.TypeCommaStringSlice,
+						Required:    false,
+						Description: "Additional field names to scrub",
+					},
+					"safe_fields": {
+						Type:        framework.TypeCommaStringSlice,
+						Required:    false,
+						Description: "Field names that are never scrubbed",
+					},
+					"enforce": {
+						Type:        framework.TypeBool,
+						Default:     false,
+						Description: "Correct drift found by the periodic reconciler",
+					},
+					"reconcile_interval": {
+						Type:        framework.TypeDurationSecond,
+						Default:     3600,
+						Description: "Interval between periodic reconciliations, 0 disables them",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: handlePrivacyPolicyRead,
+					},
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: handlePrivacyPolicyUpdate,
+					},
+					logical.DeleteOperation: &framework.PathOperation{
+						Callback: handlePrivacyPolicyDelete,
+					},
+				},
+			},
+			{
+				Pattern: "privacy/status$",
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: handlePrivacyStatusRead,
+					},
+				},
+			},
+			{
+				Pattern: "privacy/reconcile$",
+				Fields: map[string]*framework.FieldSchema{
+					"fix": {
+						Type:        framework.TypeBool,
+						Default:     false,
+						Description: "Correct the drift that is found",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.handlePrivacyReconcile,
+					},
+				},
+			},
+			{
+				Pattern: "config/self$",
+				Fields: map[string]*framework.FieldSchema{
+					"project_template": {
+						Type:        framework.TypeString,
+						Description: "Identity template that resolves the project of the caller for dsn/self",
+					},
+					"label_template": {
+						Type:        framework.TypeString,
+						Description: "Identity template that resolves the DSN label of the caller for dsn/self. The default label of the project is used when empty",
+					},
+					"integration_template": {
+						Type:        framework.TypeString,
+						Description: "Identity template that resolves the integration of the caller for creds/self",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: handleSelfConfigRead,
+					},
 					logical.UpdateOperation: &framework.PathOperation{
-						Callback: handleConfigUpdate,
+						Callback: handleSelfConfigUpdate,
+					},
+				},
+			},
+			{
+				Pattern: "config/tidy$",
+				Fields: map[string]*framework.FieldSchema{
+					"interval": {
+						Type:        framework.TypeDurationSecond,
+						Default:     86400,
+						Description: "Interval between scheduled tidy operations, 0 disables them",
+					},
+					"delete_unused_keys": {
+						Type:        framework.TypeBool,
+						Default:     false,
+						Description: "Delete untracked client keys created by the plugin that were not used within unused_key_period",
+					},
+					"unused_key_period": {
+						Type:        framework.TypeDurationSecond,
+						Default:     30 * 86400,
+						Description: "Period without events after which an untracked client key is considered unused",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: handleTidyConfigRead,
+					},
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: handleTidyConfigUpdate,
+					},
+				},
+			},
+			{
+				Pattern: "tidy/status$",
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: handleTidyStatusRead,
+					},
+				},
+			},
+			{
+				Pattern: "tidy$",
+				Fields: map[string]*framework.FieldSchema{
+					"delete_unused_keys": {
+						Type:        framework.TypeBool,
+						Description: "Delete unused client keys created by the plugin. Defaults to the tidy configuration",
+					},
+					"unused_key_period": {
+						Type:        framework.TypeDurationSecond,
+						Description: "Period without events after which a client key is considered unused. Defaults to the tidy configuration",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.handleTidy,
+					},
+				},
+			},
+			{
+				Pattern: "export$",
+				Fields: map[string]*framework.FieldSchema{
+					"include_token": {
+						Type:        framework.TypeBool,
+						Default:     false,
+						Description: "Include the sentry API token and the client certificate key in the export",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: handleExport,
+					},
+				},
+			},
+			{
+				Pattern: "import$",
+				Fields: map[string]*framework.FieldSchema{
+					"document": {
+						Type:        framework.TypeString,
+						Required:    true,
+						Description: "Document returned by export",
+					},
+					"checksum": {
+						Type:        framework.TypeString,
+						Required:    true,
+						Description: "Checksum returned by export along with the document. It only detects a corrupted or truncated document, anyone who can edit the document can also compute its checksum",
+					},
+					"mode": {
+						Type:        framework.TypeString,
+						Default:     "merge",
+						Description: "Either merge or replace. merge keeps projects and DSN that are not in the document, replace deletes them",
+					},
+					"dry_run": {
+						Type:        framework.TypeBool,
+						Default:     false,
+						Description: "Only report the changes the import would make",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.handleImport,
 					},
 				},
 			},
@@ -98,24 +420,97 @@ func New(c *logical.BackendConfig) *backend {
 						Required:    false,
 						Description: "DSN label to use by default when not specified",
 					},
+					"cas": {
+						Type:        framework.TypeInt,
+						Required:    false,
+						Description: "Only write the project if its current version matches. 0 only writes a project that does not exist yet",
+					},
 					"sentry_project": {
 						Type:        framework.TypeString,
 						Required:    false,
 						Description: "Name of the project in sentry",
 					},
+					"inbound_filters": {
+						Type:        framework.TypeMap,
+						Required:    false,
+						Description: "Inbound data filters of the project. Supports browser_extensions, web_crawlers, localhost, legacy_browsers, error_messages and releases",
+					},
+					"privacy": {
+						Type:        framework.TypeMap,
+						Required:    false,
+						Description: "Overrides of the mount privacy policy for the project",
+					},
+					"dsn_auto_create": {
+						Type:        framework.TypeBool,
+						Required:    false,
+						Description: "Create missing DSN labels in sentry when they are read, defaults to the mount setting",
+					},
+					"dsn_allowed_labels": {
+						Type:        framework.TypeCommaStringSlice,
+						Required:    false,
+						Description: "DSN labels that may be created for the project",
+					},
+					"dsn_allowed_labels_regex": {
+						Type:        framework.TypeString,
+						Required:    false,
+						Description: "Regular expression matching DSN labels that may be created for the project",
+					},
+					"max_dsn_labels": {
+						Type:        framework.TypeInt,
+						Required:    false,
+						Description: "Maximum number of DSN labels of the project, 0 means unlimited. Defaults to the mount limit",
+					},
 				},
 				Operations: map[logical.Operation]framework.OperationHandler{
 					logical.ReadOperation: &framework.PathOperation{
 						Callback: handleProjectRead,
 					},
 					logical.UpdateOperation: &framework.PathOperation{
-						Callback: handleProjectUpdate,
+						Callback: b.handleProjectUpdate,
 					},
 					logical.DeleteOperation: &framework.PathOperation{
 						Callback: handleProjectDelete,
 					},
 				},
 			},
+			// dsn/self and creds/self are matched before the paths of named
+			// projects and integrations, which would match them as well
+			{
+				Pattern: "dsn/self$",
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: b.handleDsnSelfRead,
+					},
+				},
+			},
+			{
+				Pattern: "creds/self$",
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: b.handleCredsSelfRead,
+					},
+				},
+			},
+			{
+				Pattern: "dsn/" + framework.GenericNameRegex("project") + "/$",
+				Fields: map[string]*framework.FieldSchema{
+					"project": {
+						Type:        framework.TypeString,
+						Required:    true,
+						Description: "Name of the project in Vault",
+					},
+					"include_sentry": {
+						Type:        framework.TypeBool,
+						Default:     false,
+						Description: "Also list client keys that exist in sentry but are not cached in Vault",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ListOperation: &framework.PathOperation{
+						Callback: b.handleDsnList,
+					},
+				},
+			},
 			{
 				Pattern: "dsn/" + framework.GenericNameRegex("project") + framework.OptionalParamRegex("name"),
 				Fields: map[string]*framework.FieldSchema{
@@ -129,15 +524,244 @@ func New(c *logical.BackendConfig) *backend {
 						Required:    false,
 						Description: "Name of the DSN",
 					},
+					"sentry_action": {
+						Type:        framework.TypeString,
+						Default:     "none",
+						Description: "What to do with the client key in sentry on delete. One of none, delete or disable",
+					},
+					"force": {
+						Type:        framework.TypeBool,
+						Default:     false,
+						Description: "Allow deleting the default DSN label of the project, or a label whose client key can not be found in sentry",
+					},
 				},
 				Operations: map[logical.Operation]framework.OperationHandler{
 					logical.ReadOperation: &framework.PathOperation{
-						Callback: handleDsnRead,
+						Callback: b.handleDsnRead,
+					},
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.handleDsnWrite,
+					},
+					logical.DeleteOperation: &framework.PathOperation{
+						Callback: b.handleDsnDelete,
+					},
+				},
+			},
+			{
+				Pattern: "monitors/" + framework.GenericNameRegex("project") + "/?$",
+				Fields: map[string]*framework.FieldSchema{
+					"project": {
+						Type:        framework.TypeString,
+						Required:    true,
+						Description: "Name of the project in Vault",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ListOperation: &framework.PathOperation{
+						Callback: handleMonitorsList,
+					},
+				},
+			},
+			{
+				Pattern: "monitors/" + framework.GenericNameRegex("project") + "/" + framework.GenericNameRegex("slug") + "/?$",
+				Fields: map[string]*framework.FieldSchema{
+					"project": {
+						Type:        framework.TypeString,
+						Required:    true,
+						Description: "Name of the project in Vault",
+					},
+					"slug": {
+						Type:        framework.TypeString,
+						Required:    true,
+						Description: "Slug of the monitor in sentry",
+					},
+					"name": {
+						Type:        framework.TypeString,
+						Required:    false,
+						Description: "Display name of the monitor, defaults to the slug",
+					},
+					"schedule": {
+						Type:        framework.TypeString,
+						Required:    false,
+						Description: "Crontab schedule of the job",
+					},
+					"timezone": {
+						Type:        framework.TypeString,
+						Required:    false,
+						Description: "Timezone of the schedule, defaults to UTC",
+					},
+					"checkin_margin": {
+						Type:        framework.TypeInt,
+						Required:    false,
+						Description: "Minutes after the expected time before a check-in is considered missed",
+					},
+					"max_runtime": {
+						Type:        framework.TypeInt,
+						Required:    false,
+						Description: "Minutes a job may run before it is considered failed",
+					},
+					"dsn_label": {
+						Type:        framework.TypeString,
+						Required:    false,
+						Description: "DSN label used to build the check-in URL, defaults to the project default label",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: handleMonitorRead,
+					},
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.handleMonitorUpdate,
+					},
+					logical.DeleteOperation: &framework.PathOperation{
+						Callback: b.handleMonitorDelete,
+					},
+				},
+			},
+			{
+				Pattern: "integrations/?",
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ListOperation: &framework.PathOperation{
+						Callback: handleIntegrationsList,
+					},
+				},
+			},
+			{
+				Pattern: "integration/" + framework.GenericNameRegex("name") + "/rotate$",
+				Fields: map[string]*framework.FieldSchema{
+					"name": {
+						Type:        framework.TypeString,
+						Required:    true,
+						Description: "Name of the integration in Vault",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.handleIntegrationRotate,
+					},
+				},
+			},
+			{
+				Pattern: "integration/" + framework.GenericNameRegex("name") + "/?$",
+				Fields: map[string]*framework.FieldSchema{
+					"name": {
+						Type:        framework.TypeString,
+						Required:    true,
+						Description: "Name of the integration in Vault",
+					},
+					"scopes": {
+						Type:        framework.TypeCommaStringSlice,
+						Required:    false,
+						Description: "Permission scopes granted to the integration token",
+					},
+					"events": {
+						Type:        framework.TypeCommaStringSlice,
+						Required:    false,
+						Description: "Resources the integration receives webhooks for",
+					},
+					"webhook_url": {
+						Type:        framework.TypeString,
+						Required:    false,
+						Description: "URL that receives the webhook requests",
+					},
+					"rotation_period": {
+						Type:        framework.TypeDurationSecond,
+						Required:    false,
+						Description: "Interval after which the token is rotated automatically, 0 disables rotation",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: handleIntegrationRead,
+					},
+					logical.UpdateOperation: &framework.PathOperation{
+						Callback: b.handleIntegrationUpdate,
+					},
+					logical.DeleteOperation: &framework.PathOperation{
+						Callback: b.handleIntegrationDelete,
+					},
+				},
+			},
+			{
+				Pattern: "creds/" + framework.GenericNameRegex("name") + "/?$",
+				Fields: map[string]*framework.FieldSchema{
+					"name": {
+						Type:        framework.TypeString,
+						Required:    true,
+						Description: "Name of the integration in Vault",
+					},
+				},
+				Operations: map[logical.Operation]framework.OperationHandler{
+					logical.ReadOperation: &framework.PathOperation{
+						Callback: handleCredsRead,
 					},
 				},
 			},
 		},
 	}
 
+	// Bind sentry API calls to the operation deadline and warn callers when they were throttled
+	for _, path := range b.Backend.Paths {
+		for _, handler := range path.Operations {
+			if op, ok := handler.(*framework.PathOperation); ok {
+				op.Callback = trackOperation(op.Callback)
+			}
+		}
+	}
+
 	return b
 }
+
+// readOnly returns true on nodes that can not write to the storage of the
+// mount: performance standbys and, for mounts that are not local, performance
+// secondaries. Requests that need to write are forwarded by returning
+// logical.ErrReadOnly.
+func (b *backend) readOnly() bool {
+	state := b.System().ReplicationState()
+	if state.HasState(consts.ReplicationPerformanceStandby) {
+		return true
+	}
+
+	return state.HasState(consts.ReplicationPerformanceSecondary) && !b.System().LocalMount()
+}
+
+// invalidate drops the cached client when the configuration changes on
+// another node, which includes performance standbys following the active node.
+func (b *backend) invalidate(ctx context.Context, key string) {
+	if key == KeyConfig || key == KeyConfigToken {
+		b.resetClient()
+	}
+}
+
+// clean releases the connections of the mount when it is unmounted
+func (b *backend) clean(ctx context.Context) {
+	b.cancelBackground()
+	b.resetClient()
+}
+
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	// Periodic tasks write their results, which only the active node can do
+	if b.readOnly() {
+		return nil
+	}
+
+	tasks := []struct {
+		name string
+		run  func(context.Context, logical.Storage) error
+	}{
+		{"integration rotation", b.rotateDueIntegrations},
+		{"privacy reconciliation", b.reconcilePrivacyIfDue},
+		{"tidy", b.tidyIfDue},
+	}
+
+	var result error
+	for _, task := range tasks {
+		err := task.run(ctx, req.Storage)
+		if err != nil {
+			b.Logger().Error("periodic task failed", "task", task.name, "error", err)
+			result = err
+		}
+	}
+
+	return result
+}
@@ -2,24 +2,33 @@ package backend
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/vault/sdk/logical"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 )
 
 type testSentryHandler struct {
 	mux *http.ServeMux
 	url string
+
+	// scopes are the scopes reported by the API root per token.
+	// Tokens that are not listed have every scope.
+	scopes sync.Map
 }
 
 var localSentry = &testSentryHandler{
 	mux: http.NewServeMux(),
 }
 
+var testAllScopes = []string{"org:admin", "project:admin", "team:admin", "member:admin", "event:admin"}
+
 func TestMain(m *testing.M) {
 	log.Println("====> Starting test server")
 
@@ -32,6 +41,22 @@ func TestMain(m *testing.M) {
 }
 
 func (m *testSentryHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	// The API root can not be registered on the mux without
+	// catching every request that has no handler
+	if req.URL.Path == "/" {
+		scopes := testAllScopes
+		if v, ok := m.scopes.Load(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")); ok {
+			scopes = v.([]string)
+		}
+
+		json.NewEncoder(resp).Encode(map[string]interface{}{
+			"version": "0",
+			"auth":    map[string]interface{}{"scopes": scopes},
+		})
+
+		return
+	}
+
 	h, p := m.mux.Handler(req)
 
 	if p == "" {
@@ -50,13 +75,71 @@ func (m *testSentryHandler) handleStatic(route string, code int, content string)
 	})
 }
 
+// handleMethods registers a handler that responds based on the request method
+func (m *testSentryHandler) handleMethods(route string, responses map[string]testResponse) {
+	log.Printf("====> registering method handler for %s", route)
+	m.mux.HandleFunc(route, func(resp http.ResponseWriter, req *http.Request) {
+		r, ok := responses[req.Method]
+		if !ok {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		resp.WriteHeader(r.code)
+		resp.Write([]byte(r.content))
+	})
+}
+
+type testResponse struct {
+	code    int
+	content string
+}
+
 func testGetBackend(t *testing.T) logical.Backend {
+	b, _ := testGetBackendWithStorage(t)
+	return b
+}
+
+// testGetBackendWithStorage returns the backend along with its storage for
+// tests that need to inspect or prepare the stored entries directly.
+func testGetBackendWithStorage(t *testing.T) (logical.Backend, logical.Storage) {
+	storage := &logical.InmemStorage{}
 	config := logical.TestBackendConfig()
-	config.StorageView = &logical.InmemStorage{}
+	config.StorageView = storage
 	b, err := Factory(context.Background(), config)
 	if err != nil {
 		t.Fatalf("failed to initialize backend factory. %s", err)
 	}
 
-	return b
+	return b, storage
+}
+
+// testSeedStorage writes the entries to storage as JSON
+func testSeedStorage(t *testing.T, storage logical.Storage, entries map[string]interface{}) {
+	for key, value := range entries {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			t.Fatalf("failed to encode %s. %s", key, err)
+		}
+
+		err = storage.Put(context.Background(), entry)
+		if err != nil {
+			t.Fatalf("failed to store %s. %s", key, err)
+		}
+	}
+}
+
+// testSentryError checks that the response reports a failed sentry API call
+// with the given status code and an error containing msg.
+func testSentryError(resp *logical.Response, code int, msg string) error {
+	if resp == nil || resp.Data[logical.HTTPStatusCode] != code {
+		return fmt.Errorf("expected response with status code %d, got %v", code, resp)
+	}
+
+	body, _ := resp.Data[logical.HTTPRawBody].(string)
+	if !strings.Contains(body, msg) {
+		return fmt.Errorf("unexpected response body %q does not contain %q", body, msg)
+	}
+
+	return nil
 }
@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/atlassian/go-sentry-api"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+	"net/http"
+	"strings"
+)
+
+// InboundFilters are the data filters sentry applies to events of a project
+// before they are stored.
+type InboundFilters struct {
+	BrowserExtensions bool     `json:"browser_extensions"`
+	WebCrawlers       bool     `json:"web_crawlers"`
+	Localhost         bool     `json:"localhost"`
+	LegacyBrowsers    []string `json:"legacy_browsers"`
+	ErrorMessages     []string `json:"error_messages"`
+	Releases          []string `json:"releases"`
+}
+
+func (f *InboundFilters) Data() map[string]interface{} {
+	return map[string]interface{}{
+		"browser_extensions": f.BrowserExtensions,
+		"web_crawlers":       f.WebCrawlers,
+		"localhost":          f.Localhost,
+		"legacy_browsers":    f.LegacyBrowsers,
+		"error_messages":     f.ErrorMessages,
+		"releases":           f.Releases,
+	}
+}
+
+// parseInboundFilters builds the filters from the raw inbound_filters field.
+// Filters that are not present in the input are disabled.
+func parseInboundFilters(raw map[string]interface{}) (*InboundFilters, error) {
+	f := &InboundFilters{
+		LegacyBrowsers: []string{},
+		ErrorMessages:  []string{},
+		Releases:       []string{},
+	}
+
+	for key, value := range raw {
+		var err error
+		switch key {
+		case "browser_extensions":
+			f.BrowserExtensions, err = parseutil.ParseBool(value)
+		case "web_crawlers":
+			f.WebCrawlers, err = parseutil.ParseBool(value)
+		case "localhost":
+			f.Localhost, err = parseutil.ParseBool(value)
+		case "legacy_browsers":
+			f.LegacyBrowsers, err = parseutil.ParseCommaStringSlice(value)
+		case "error_messages":
+			f.ErrorMessages, err = parseutil.ParseCommaStringSlice(value)
+		case "releases":
+			f.Releases, err = parseutil.ParseCommaStringSlice(value)
+		default:
+			err = fmt.Errorf("unknown filter")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for inbound filter %s. %s", key, err)
+		}
+	}
+
+	return f, nil
+}
+
+type sentryFilterState struct {
+	Active     *bool     `json:"active,omitempty"`
+	Subfilters *[]string `json:"subfilters,omitempty"`
+}
+
+// applyInboundFilters pushes the filters to the project in sentry
+func applyInboundFilters(client *sentry.Client, org, project string, f *InboundFilters) error {
+	toggles := []struct {
+		id     string
+		active bool
+	}{
+		{"browser-extensions", f.BrowserExtensions},
+		{"web-crawlers", f.WebCrawlers},
+		{"localhost", f.Localhost},
+	}
+
+	for _, t := range toggles {
+		active := t.active
+		err := sentryRequest(client, http.MethodPut,
+			fmt.Sprintf("projects/%s/%s/filters/%s/", org, project, t.id),
+			&sentryFilterState{Active: &active}, nil)
+
+		if err != nil {
+			return fmt.Errorf("failed to update %s filter. %w", t.id, err)
+		}
+	}
+
+	subfilters := f.LegacyBrowsers
+	err := sentryRequest(client, http.MethodPut,
+		fmt.Sprintf("projects/%s/%s/filters/legacy-browsers/", org, project),
+		&sentryFilterState{Subfilters: &subfilters}, nil)
+
+	if err != nil {
+		return fmt.Errorf("failed to update legacy-browsers filter. %w", err)
+	}
+
+	options := map[string]interface{}{
+		"options": map[string]string{
+			"filters:error_messages": strings.Join(f.ErrorMessages, "\n"),
+			"filters:releases":       strings.Join(f.Releases, "\n"),
+		},
+	}
+
+	err = sentryRequest(client, http.MethodPut, fmt.Sprintf("projects/%s/%s/", org, project), options, nil)
+	if err != nil {
+		return fmt.Errorf("failed to update blocklist filters. %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,274 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/atlassian/go-sentry-api"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+const KeySchema = "schema"
+
+// schemaVersion is the version of the storage layout used by this plugin
+// version. It must match the version of the last migration.
+const schemaVersion = 3
+
+// SchemaStatus records the storage layout version of the mount and the
+// outcome of the last migration run.
+type SchemaStatus struct {
+	Version    int       `json:"version"`
+	MigratedAt time.Time `json:"migrated_at"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// migration upgrades the storage to its version. Migrations are resumable:
+// they may be interrupted at any point and must be safe to run again on
+// entries that were already migrated.
+type migration struct {
+	version     int
+	description string
+	run         func(b *backend, ctx context.Context, storage logical.Storage) error
+}
+
+var migrations = []migration{
+	{version: 1, description: "store the sentry API token apart from the config", run: (*backend).migrateConfigToken},
+	{version: 2, description: "record the sentry slug of projects", run: (*backend).migrateProjectSlugs},
+	{version: 3, description: "start versioning projects", run: (*backend).migrateProjectVersions},
+}
+
+func loadSchemaStatus(ctx context.Context, storage logical.Storage) (*SchemaStatus, error) {
+	entry, err := storage.Get(ctx, KeySchema)
+	if err != nil {
+		return nil, err
+	}
+
+	item := new(SchemaStatus)
+	if entry == nil {
+		return item, nil
+	}
+
+	err = entry.DecodeJSON(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func storeSchemaStatus(ctx context.Context, storage logical.Storage, item *SchemaStatus) error {
+	entry, err := logical.StorageEntryJSON(KeySchema, item)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
+}
+
+// initialize migrates the storage of the mount to the current schema when
+// a new plugin version is loaded. A failed migration is recorded and logged
+// without failing the mount, and is resumed the next time the mount is
+// initialized. Entries that were not migrated yet are still readable.
+func (b *backend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	if b.readOnly() {
+		return nil
+	}
+
+	status, err := loadSchemaStatus(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	if status.Version > schemaVersion {
+		b.Logger().Warn("storage was written by a newer plugin version, skipping migrations", "version", status.Version, "supported", schemaVersion)
+		return nil
+	}
+
+	for _, m := range migrations {
+		if m.version <= status.Version {
+			continue
+		}
+
+		b.Logger().Info("migrating storage", "version", m.version, "migration", m.description)
+
+		err = m.run(b, ctx, req.Storage)
+		if err != nil {
+			status.Error = fmt.Sprintf("migration to version %d failed. %s", m.version, err)
+			b.Logger().Error("failed to migrate storage", "version", m.version, "error", err)
+			return storeSchemaStatus(ctx, req.Storage, status)
+		}
+
+		status.Version = m.version
+		status.MigratedAt = time.Now().UTC()
+		status.Error = ""
+
+		err = storeSchemaStatus(ctx, req.Storage, status)
+		if err != nil {
+			return err
+		}
+
+		b.Logger().Info("migrated storage", "version", m.version)
+	}
+
+	return nil
+}
+
+// migrateConfigToken moves an API token that is stored inline in the
+// config to its own seal wrapped entry.
+func (b *backend) migrateConfigToken(ctx context.Context, storage logical.Storage) error {
+	entry, err := storage.Get(ctx, KeyConfig)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	inline := new(SentryOrg)
+	err = entry.DecodeJSON(inline)
+	if err != nil {
+		return err
+	}
+
+	if inline.ApiToken == "" && inline.ClientKey == "" {
+		return nil
+	}
+
+	config, err := loadConfig(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	return storeConfig(ctx, storage, config)
+}
+
+// migrateProjectSlugs records the sentry ID and slug of projects stored
+// before they were tracked. Those entries only have the name of the sentry
+// project, which older versions passed as its slug. They are resolved to the
+// sentry project with that slug or, failing that, to the only project with
+// that name. Projects that can not be resolved are logged and left without
+// a slug.
+func (b *backend) migrateProjectSlugs(ctx context.Context, storage logical.Storage) error {
+	names, err := storage.List(ctx, KeyProjectConfigPrefix)
+	if err != nil {
+		return err
+	}
+
+	var legacy []*SentryProject
+	for _, name := range names {
+		project, err := loadProject(ctx, storage, name)
+		if err != nil {
+			return err
+		}
+
+		if project != nil && project.Slug == "" && project.SentryID == "" {
+			legacy = append(legacy, project)
+		}
+	}
+
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	config, err := loadConfig(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	if config == nil {
+		b.Logger().Warn("plugin is not configured, projects stored without their sentry slug are not resolved", "projects", len(legacy))
+		return nil
+	}
+
+	client, release, err := uncachedClient(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	projects, err := listOrgProjects(client, config.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, project := range legacy {
+		found := findLegacyProject(projects, project.DisplayName)
+		if found == nil {
+			b.Logger().Warn("failed to resolve the sentry project of a project stored without its slug", "project", project.Name, "sentry_project", project.DisplayName)
+			continue
+		}
+
+		project.SentryID = found.ID
+		project.Slug = *found.Slug
+		project.DisplayName = found.Name
+
+		entry, err := logical.StorageEntryJSON(KeyProjectConfigPrefix+project.Name, project)
+		if err != nil {
+			return err
+		}
+
+		err = storage.Put(ctx, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findLegacyProject returns the sentry project with the slug, or else the
+// only sentry project with the name. It returns nil when the name is ambiguous.
+func findLegacyProject(projects []sentry.Project, name string) *sentry.Project {
+	var named []*sentry.Project
+	for i, p := range projects {
+		if p.Slug == nil {
+			continue
+		}
+
+		if *p.Slug == name {
+			return &projects[i]
+		}
+
+		if p.Name == name {
+			named = append(named, &projects[i])
+		}
+	}
+
+	if len(named) != 1 {
+		return nil
+	}
+
+	return named[0]
+}
+
+// migrateProjectVersions sets the version of projects stored before they
+// were versioned to 1, so that a check-and-set of 0 only creates projects.
+func (b *backend) migrateProjectVersions(ctx context.Context, storage logical.Storage) error {
+	names, err := storage.List(ctx, KeyProjectConfigPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		project, err := loadProject(ctx, storage, name)
+		if err != nil {
+			return err
+		}
+
+		if project == nil || project.Version > 0 {
+			continue
+		}
+
+		project.Version = 1
+
+		entry, err := logical.StorageEntryJSON(KeyProjectConfigPrefix+name, project)
+		if err != nil {
+			return err
+		}
+
+		err = storage.Put(ctx, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
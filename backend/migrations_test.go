@@ -0,0 +1,117 @@
+package backend
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestInitializeMigrations(t *testing.T) {
+	ctx := context.Background()
+	b, storage := testGetBackendWithStorage(t)
+
+	testSeedStorage(t, storage, map[string]interface{}{
+		// Configurations of the first plugin version only had these settings
+		KeyConfig: map[string]interface{}{
+			"name":               "migrate-org",
+			"api_token":          "legacy-token",
+			"endpoint":           localSentry.url,
+			"connection_timeout": 10,
+		},
+		KeyProjectConfigPrefix + "old-app": &SentryProject{Name: "old-app", DisplayName: "old-app-slug"},
+		KeyProjectConfigPrefix + "new-app": &SentryProject{Name: "new-app", DisplayName: "New App", SentryID: "3", Slug: "new-app"},
+		// Older versions stored the name of the sentry project, which may differ from its slug
+		KeyProjectConfigPrefix + "named-app": &SentryProject{Name: "named-app", DisplayName: "Named App"},
+		KeyProjectConfigPrefix + "twin-app":  &SentryProject{Name: "twin-app", DisplayName: "Twin App"},
+		KeyProjectConfigPrefix + "gone-app":  &SentryProject{Name: "gone-app", DisplayName: "Gone App"},
+	})
+
+	localSentry.handleStatic("/organizations/migrate-org/projects/", http.StatusOK, `[
+		{"id": "8", "name": "Old App", "slug": "old-app-slug"},
+		{"id": "9", "name": "Named App", "slug": "named-app-b3"},
+		{"id": "10", "name": "Twin App", "slug": "twin-app-1"},
+		{"id": "11", "name": "Twin App", "slug": "twin-app-2"}
+	]`)
+
+	read := func() map[string]interface{} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "info",
+			Storage:   storage,
+		})
+
+		if err != nil || resp.IsError() {
+			t.Fatalf("failed to read info. %v %v", resp, err)
+		}
+
+		return resp.Data
+	}
+
+	if info := read(); info["schema_version"] != 0 || info["migration_status"] != "pending" {
+		t.Errorf("expected pending migration before initialization, got %v", info)
+	}
+
+	// Running the migrations again must leave the migrated entries as they are
+	for i := 0; i < 2; i++ {
+		err := b.Initialize(ctx, &logical.InitializationRequest{Storage: storage})
+		if err != nil {
+			t.Fatalf("failed to initialize backend. %s", err)
+		}
+	}
+
+	if info := read(); info["schema_version"] != schemaVersion || info["migration_status"] != "complete" {
+		t.Errorf("expected complete migration after initialization, got %v", info)
+	}
+
+	entry, err := storage.Get(ctx, KeyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(entry.Value), "legacy-token") {
+		t.Errorf("expected the token to be moved out of the config entry, got %s", entry.Value)
+	}
+
+	config, err := loadConfig(ctx, storage)
+	if err != nil || config.ApiToken != "legacy-token" {
+		t.Errorf("expected the migrated token to be loaded, got %v %v", config, err)
+	}
+
+	settings := []int{config.DsnStaleIfError, config.RateLimit, config.RateLimitBurst, config.MaxRetries, config.OperationTimeout}
+	defaults := []int{defaultDsnStaleIfError, defaultRateLimit, defaultRateLimitBurst, defaultMaxRetries, defaultOperationTimeout}
+	if !cmp.Equal(settings, defaults) || config.ConnectionTimeout != 10 {
+		t.Errorf("expected settings missing from the legacy config to get their defaults, got %+v", config)
+	}
+
+	// Projects whose name is ambiguous or unknown in sentry are left without a slug
+	expect := map[string]string{"old-app": "old-app-slug", "new-app": "new-app", "named-app": "named-app-b3", "twin-app": "", "gone-app": ""}
+	for name, slug := range expect {
+		project, err := loadProject(ctx, storage, name)
+		if err != nil || project.Slug != slug || project.Version != 1 {
+			t.Errorf("expected project %s to have slug %s and version 1, got %v %v", name, slug, project, err)
+		}
+	}
+}
+
+func TestInitializeNewerSchema(t *testing.T) {
+	ctx := context.Background()
+	b, storage := testGetBackendWithStorage(t)
+
+	testSeedStorage(t, storage, map[string]interface{}{
+		KeySchema:                          &SchemaStatus{Version: schemaVersion + 1},
+		KeyProjectConfigPrefix + "old-app": &SentryProject{Name: "old-app", DisplayName: "old-app-slug"},
+	})
+
+	err := b.Initialize(ctx, &logical.InitializationRequest{Storage: storage})
+	if err != nil {
+		t.Fatalf("failed to initialize backend. %s", err)
+	}
+
+	project, err := loadProject(ctx, storage, "old-app")
+	if err != nil || project.Slug != "" {
+		t.Errorf("expected storage of a newer plugin version to be left as is, got %v %v", project, err)
+	}
+}
@@ -2,29 +2,84 @@ package backend
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"github.com/atlassian/go-sentry-api"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"net/url"
 	"strings"
+	"time"
 )
 
-const KeyConfig string = "config"
+const (
+	KeyConfig      string = "config"
+	KeyConfigToken string = "config/token"
+)
+
+// Defaults of config settings that configurations written by older plugin
+// versions do not have. They apply when the config is loaded, until the
+// config is stored again with the settings.
+const (
+	defaultDsnStaleIfError  = 86400
+	defaultRateLimit        = 10
+	defaultRateLimitBurst   = 20
+	defaultMaxRetries       = 3
+	defaultOperationTimeout = 60
+)
 
 type SentryOrg struct {
 	Name              string `json:"name"`
 	DisplayName       string `json:"display_name"`
-	ApiToken          string `json:"api_token"`
+	ApiToken          string `json:"api_token,omitempty"`
 	Endpoint          string `json:"endpoint"`
 	ConnectionTimeout int    `json:"connection_timeout"`
+	DsnAutoCreate     bool   `json:"dsn_auto_create"`
+	MaxDsnLabels      int    `json:"max_dsn_labels"`
+	DsnCacheTTL       int    `json:"dsn_cache_ttl"`
+	DsnStaleIfError   int    `json:"dsn_stale_if_error"`
+	RateLimit         int    `json:"rate_limit"`
+	RateLimitBurst    int    `json:"rate_limit_burst"`
+	MaxRetries        int    `json:"max_retries"`
+	OperationTimeout  int    `json:"operation_timeout"`
+	CACert            string `json:"ca_cert"`
+	ClientCert        string `json:"client_cert"`
+	ClientKey         string `json:"client_key,omitempty"`
+	ProxyURL          string `json:"proxy_url"`
+	TLSMinVersion     string `json:"tls_min_version"`
+
+	TokenChangedAt time.Time `json:"token_changed_at"`
 }
 
 func (o *SentryOrg) Data() map[string]interface{} {
-	return map[string]interface{}{
-		"name":         o.Name,
-		"display_name": o.DisplayName,
-		"endpoint":     o.Endpoint,
-		"timeout":      o.ConnectionTimeout,
+	data := map[string]interface{}{
+		"name":               o.Name,
+		"display_name":       o.DisplayName,
+		"endpoint":           o.Endpoint,
+		"timeout":            o.ConnectionTimeout,
+		"dsn_auto_create":    o.DsnAutoCreate,
+		"max_dsn_labels":     o.MaxDsnLabels,
+		"dsn_cache_ttl":      o.DsnCacheTTL,
+		"dsn_stale_if_error": o.DsnStaleIfError,
+		"rate_limit":         o.RateLimit,
+		"rate_limit_burst":   o.RateLimitBurst,
+		"max_retries":        o.MaxRetries,
+		"operation_timeout":  o.OperationTimeout,
+		"ca_cert":            o.CACert,
+		"client_cert":        o.ClientCert,
+		"proxy_url":          redactURL(o.ProxyURL),
+		"tls_min_version":    o.TLSMinVersion,
+		"token_fingerprint":  tokenFingerprint(o.ApiToken),
 	}
+
+	// Configurations written before changes of the token were
+	// tracked do not know when it was last changed
+	if !o.TokenChangedAt.IsZero() {
+		data["token_last_changed"] = o.TokenChangedAt.Format(time.RFC3339)
+	}
+
+	return data
 }
 
 func (o *SentryOrg) Client() (*sentry.Client, error) {
@@ -35,55 +90,242 @@ func (o *SentryOrg) Client() (*sentry.Client, error) {
 	return client, nil
 }
 
-func handleConfigUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	orgSlug := data.Get("org").(string)
-	token := data.Get("token").(string)
-	endpoint := data.Get("endpoint").(string)
-	timeout := data.Get("timeout").(int)
+func (b *backend) handleConfigUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	existing, err := loadConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
 
-	endpoint = strings.TrimRight(endpoint, "/") + "/"
+	item := new(SentryOrg)
+	if existing != nil {
+		*item = *existing
+	}
+
+	// Settings that are not given keep their stored value, or take
+	// their default when the plugin is configured for the first time
+	given := func(key string) bool {
+		_, ok := data.GetOk(key)
+		return ok || existing == nil
+	}
 
-	uo := &SentryOrg{
-		ApiToken:          token,
-		Endpoint:          endpoint,
-		ConnectionTimeout: timeout,
+	orgSlug := item.Name
+	if v, ok := data.GetOk("org"); ok {
+		orgSlug = v.(string)
 	}
 
-	client, err := uo.Client()
+	if orgSlug == "" {
+		return logical.ErrorResponse("org is required"), nil
+	}
+
+	if v, ok := data.GetOk("token"); ok && v.(string) != item.ApiToken {
+		item.ApiToken = v.(string)
+		item.TokenChangedAt = time.Now().UTC()
+	}
+
+	if item.ApiToken == "" {
+		return logical.ErrorResponse("token is required"), nil
+	}
+
+	if given("endpoint") {
+		item.Endpoint = strings.TrimRight(data.Get("endpoint").(string), "/") + "/"
+	}
+
+	if given("timeout") {
+		item.ConnectionTimeout = data.Get("timeout").(int)
+	}
+
+	if given("dsn_auto_create") {
+		item.DsnAutoCreate = data.Get("dsn_auto_create").(bool)
+	}
+
+	if given("max_dsn_labels") {
+		item.MaxDsnLabels = data.Get("max_dsn_labels").(int)
+		if item.MaxDsnLabels < 0 {
+			return logical.ErrorResponse("max_dsn_labels must not be negative"), nil
+		}
+	}
+
+	if given("dsn_cache_ttl") {
+		item.DsnCacheTTL = data.Get("dsn_cache_ttl").(int)
+	}
+
+	if given("dsn_stale_if_error") {
+		item.DsnStaleIfError = data.Get("dsn_stale_if_error").(int)
+	}
+
+	if given("rate_limit") {
+		item.RateLimit = data.Get("rate_limit").(int)
+	}
+
+	if given("rate_limit_burst") {
+		item.RateLimitBurst = data.Get("rate_limit_burst").(int)
+	}
+
+	if given("max_retries") {
+		item.MaxRetries = data.Get("max_retries").(int)
+	}
+
+	if given("operation_timeout") {
+		item.OperationTimeout = data.Get("operation_timeout").(int)
+	}
+
+	if given("ca_cert") {
+		item.CACert = data.Get("ca_cert").(string)
+	}
+
+	if given("client_cert") {
+		item.ClientCert = data.Get("client_cert").(string)
+	}
+
+	if given("client_key") {
+		item.ClientKey = data.Get("client_key").(string)
+	}
+
+	if given("proxy_url") {
+		item.ProxyURL = data.Get("proxy_url").(string)
+
+		// The settings are not seal wrapped like the token, so they
+		// must not hold the credentials of the proxy
+		if u, err := url.Parse(item.ProxyURL); err == nil && u.User != nil {
+			return logical.ErrorResponse("proxy_url must not contain credentials, set them in the proxy environment variables of vault instead"), nil
+		}
+	}
+
+	if given("tls_min_version") {
+		item.TLSMinVersion = data.Get("tls_min_version").(string)
+	}
+
+	// The cached client keeps serving the stored configuration until
+	// the new one is validated and stored
+	client, release, err := uncachedClient(ctx, item)
 	if err != nil {
 		return logical.ErrorResponse("failed to initialize sentry client with given configuration. %s", err), nil
 	}
 
+	defer release()
+
 	org, err := client.GetOrganization(orgSlug)
 	if err != nil {
-		return logical.ErrorResponse("failed to retrieve organization details from sentry. %s", err), nil
+		return sentryErrorResponse(ctx, req, err, "failed to retrieve organization details from sentry")
 	}
 
-	item := new(SentryOrg)
+	item.Name = orgSlug
 	if org.Slug != nil {
 		item.Name = *org.Slug
 	}
 
 	item.DisplayName = org.Name
-	item.ApiToken = token
-	item.Endpoint = endpoint
-	item.ConnectionTimeout = timeout
 
-	entry, err := logical.StorageEntryJSON(KeyConfig, item)
+	var warnings []string
+	scopes, known, err := tokenScopes(client)
 	if err != nil {
-		return nil, err
+		return sentryErrorResponse(ctx, req, err, "failed to retrieve the scopes of the token from sentry")
+	}
+
+	if !known {
+		warnings = append(warnings, "sentry did not report the scopes of the token, some features may not be available")
 	}
 
-	err = req.Storage.Put(ctx, entry)
+	if unavailable, required := unavailableFeatures(scopes); known && len(unavailable) > 0 {
+		if required && !data.Get("allow_missing_scopes").(bool) {
+			return logical.ErrorResponse("token can not be used for %s, set allow_missing_scopes to accept it anyway", strings.Join(unavailable, "; ")), nil
+		}
+
+		for _, feature := range unavailable {
+			warnings = append(warnings, fmt.Sprintf("%s is not available with the token", feature))
+		}
+	}
+
+	err = storeConfig(ctx, req.Storage, item)
 	if err != nil {
 		return nil, err
 	}
 
+	b.resetClient()
+
 	return &logical.Response{
-		Data: item.Data(),
+		Data:     item.Data(),
+		Warnings: warnings,
 	}, nil
 }
 
+func handleConfigExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	entry, err := req.Storage.Get(ctx, KeyConfig)
+	if err != nil {
+		return false, err
+	}
+
+	return entry != nil, nil
+}
+
+func (b *backend) handleConfigDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	force := data.Get("force").(bool)
+
+	projects, err := req.Storage.List(ctx, KeyProjectConfigPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(projects) > 0 && !force {
+		return logical.ErrorResponse("%d projects are still configured, delete them first or set force to remove the configuration", len(projects)), nil
+	}
+
+	for _, key := range []string{KeyConfigToken, KeyConfig} {
+		err = req.Storage.Delete(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b.resetClient()
+
+	return nil, nil
+}
+
+// tokenFingerprint identifies the token without revealing it
+func tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sentryOrgToken holds the API token of the organization and the key
+// of the client certificate. They are stored apart from the other
+// settings in a seal wrapped entry.
+type sentryOrgToken struct {
+	Token     string `json:"token"`
+	ClientKey string `json:"client_key,omitempty"`
+}
+
+// storeConfig stores the settings and the API token of the organization
+// in separate entries. The token entry is written first so that a failure
+// never leaves the settings pointing at a missing token.
+func storeConfig(ctx context.Context, storage logical.Storage, item *SentryOrg) error {
+	entry, err := logical.StorageEntryJSON(KeyConfigToken, &sentryOrgToken{Token: item.ApiToken, ClientKey: item.ClientKey})
+	if err != nil {
+		return err
+	}
+
+	err = storage.Put(ctx, entry)
+	if err != nil {
+		return err
+	}
+
+	settings := *item
+	settings.ApiToken = ""
+	settings.ClientKey = ""
+
+	entry, err = logical.StorageEntryJSON(KeyConfig, &settings)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
+}
+
 func loadConfig(ctx context.Context, storage logical.Storage) (*SentryOrg, error) {
 	entry, err := storage.Get(ctx, KeyConfig)
 	if err != nil {
@@ -94,12 +336,38 @@ func loadConfig(ctx context.Context, storage logical.Storage) (*SentryOrg, error
 		return nil, nil
 	}
 
-	item := new(SentryOrg)
+	// Settings missing from the entry keep their defaults
+	item := &SentryOrg{
+		DsnStaleIfError:  defaultDsnStaleIfError,
+		RateLimit:        defaultRateLimit,
+		RateLimitBurst:   defaultRateLimitBurst,
+		MaxRetries:       defaultMaxRetries,
+		OperationTimeout: defaultOperationTimeout,
+	}
+
 	err = entry.DecodeJSON(item)
 	if err != nil {
 		return nil, err
 	}
 
+	entry, err = storage.Get(ctx, KeyConfigToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// Configurations written before the token was split out keep
+	// it inline until the next update of the config
+	if entry != nil {
+		token := new(sentryOrgToken)
+		err = entry.DecodeJSON(token)
+		if err != nil {
+			return nil, err
+		}
+
+		item.ApiToken = token.Token
+		item.ClientKey = token.ClientKey
+	}
+
 	return item, nil
 }
 
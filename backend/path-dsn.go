@@ -2,16 +2,46 @@ package backend
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/atlassian/go-sentry-api"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
 )
 
 const KeyDsnPrefix = "dsn/"
 
 type SentryDsn struct {
-	Name string `json:"name"`
-	DSN  string `json:"dsn"`
+	Name        string    `json:"name"`
+	DSN         string    `json:"dsn"`
+	KeyID       string    `json:"key_id"`
+	Active      bool      `json:"active"`
+	DateCreated time.Time `json:"date_created"`
+	FetchedAt   time.Time `json:"fetched_at"`
+
+	// RevalidateError is the reason the last revalidation with sentry failed
+	RevalidateError string `json:"revalidate_error,omitempty"`
+
+	// created is set when the key was created in sentry by this request
+	created bool
+}
+
+func newSentryDsn(key *clientKey) *SentryDsn {
+	return &SentryDsn{
+		Name:        key.Label,
+		DSN:         key.DSN.Public,
+		KeyID:       key.ID,
+		Active:      key.IsActive,
+		DateCreated: key.DateCreated,
+		FetchedAt:   time.Now().UTC(),
+		created:     key.created,
+	}
 }
 
 func (d *SentryDsn) Data() map[string]interface{} {
@@ -40,7 +70,7 @@ func loadDsn(ctx context.Context, storage logical.Storage, project, label string
 	return item, err
 }
 
-func handleDsnRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+func (b *backend) handleDsnRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	vaultProjectName := data.Get("project").(string)
 	dsnName := data.Get("name").(string)
 
@@ -66,6 +96,126 @@ func handleDsnRead(ctx context.Context, req *logical.Request, data *framework.Fi
 		return nil, err
 	}
 
+	config, err := loadConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if dsn != nil {
+		return b.readCachedDsn(ctx, req, config, vaultProject, dsn)
+	}
+
+	if config == nil {
+		return logical.ErrorResponse("plugin is not configured"), nil
+	}
+
+	// The cache can not be populated here, let the active node serve the read
+	if b.readOnly() {
+		return nil, logical.ErrReadOnly
+	}
+
+	// Concurrent reads of the same label wait for the first one to populate the cache
+	lock := b.dsnLock(vaultProjectName, dsnName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	dsn, err = loadDsn(ctx, req.Storage, vaultProjectName, dsnName)
+	if err != nil {
+		return nil, err
+	}
+
+	if dsn != nil {
+		return &logical.Response{
+			Data: dsn.Data(),
+		}, nil
+	}
+
+	client, err := b.client(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reads only create keys when the project allows it, otherwise
+	// they are limited to keys that already exist in sentry.
+	create := vaultProject.dsnAutoCreate(config) && vaultProject.dsnLabelAllowed(dsnName)
+
+	quota, err := loadDsnQuota(ctx, req.Storage, config, vaultProject)
+	if err != nil {
+		return nil, err
+	}
+
+	var key *clientKey
+	err = b.withProject(ctx, req.Storage, client, config, vaultProject, func(slug string) (err error) {
+		key, err = fetchKeyOrMakeNew(
+			client,
+			sentry.Organization{Slug: &config.Name},
+			sentry.Project{Slug: &slug},
+			dsnName,
+			create,
+			quota,
+		)
+
+		return err
+	})
+
+	// Writes to labels the project does not allow are refused as well
+	if err == errDsnNotFound && !vaultProject.dsnLabelAllowed(dsnName) {
+		return logical.ErrorResponse("DSN label %s is not allowed for project %s", dsnName, vaultProjectName), nil
+	}
+
+	if err == errDsnNotFound {
+		return logical.ErrorResponse("DSN %s does not exist for project %s, write to the label to create it", dsnName, vaultProjectName), nil
+	}
+
+	if err != nil {
+		return sentryErrorResponse(ctx, req, err, "failed to retrieve client keys from sentry")
+	}
+
+	item, err := b.storeKey(ctx, req.Storage, config, vaultProject, dsnName, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: item.Data(),
+	}, nil
+}
+
+func (b *backend) handleDsnWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// The created key could not be stored here, let the active node create it
+	if b.readOnly() {
+		return nil, logical.ErrReadOnly
+	}
+
+	vaultProjectName := data.Get("project").(string)
+	dsnName := data.Get("name").(string)
+
+	if dsnName == "" {
+		return logical.ErrorResponse("DSN label is required"), nil
+	}
+
+	vaultProject, err := loadProject(ctx, req.Storage, vaultProjectName)
+	if err != nil {
+		return nil, err
+	}
+
+	if vaultProject == nil {
+		return logical.ErrorResponse("project %s is not configured", vaultProjectName), nil
+	}
+
+	if !vaultProject.dsnLabelAllowed(dsnName) {
+		return logical.ErrorResponse("DSN label %s is not allowed for project %s", dsnName, vaultProjectName), nil
+	}
+
+	lock := b.dsnLock(vaultProjectName, dsnName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	dsn, err := loadDsn(ctx, req.Storage, vaultProjectName, dsnName)
+	if err != nil {
+		return nil, err
+	}
+
 	if dsn != nil {
 		return &logical.Response{
 			Data: dsn.Data(),
@@ -81,44 +231,394 @@ func handleDsnRead(ctx context.Context, req *logical.Request, data *framework.Fi
 		return logical.ErrorResponse("plugin is not configured"), nil
 	}
 
-	client, err := config.Client()
+	client, err := b.client(ctx, config)
 	if err != nil {
 		return nil, err
 	}
 
-	key, err := fetchKeyOrMakeNew(
-		client,
-		sentry.Organization{Slug: &config.Name},
-		sentry.Project{Slug: &vaultProject.DisplayName},
-		dsnName,
-	)
-
+	quota, err := loadDsnQuota(ctx, req.Storage, config, vaultProject)
 	if err != nil {
-		return logical.ErrorResponse("failed to retrieve client keys from sentry. %s", err), nil
+		return nil, err
 	}
 
-	item := &SentryDsn{
-		Name: key.Label,
-		DSN:  key.DSN.Public,
+	var key *clientKey
+	err = b.withProject(ctx, req.Storage, client, config, vaultProject, func(slug string) (err error) {
+		key, err = fetchKeyOrMakeNew(
+			client,
+			sentry.Organization{Slug: &config.Name},
+			sentry.Project{Slug: &slug},
+			dsnName,
+			true,
+			quota,
+		)
+
+		return err
+	})
+
+	if err != nil {
+		return sentryErrorResponse(ctx, req, err, "failed to create client key in sentry")
 	}
 
-	entry, err := logical.StorageEntryJSON(KeyDsnPrefix+vaultProjectName+"/"+dsnName, item)
+	item, err := b.storeKey(ctx, req.Storage, config, vaultProject, dsnName, key)
 	if err != nil {
 		return nil, err
 	}
 
-	err = req.Storage.Put(ctx, entry)
+	return &logical.Response{
+		Data: item.Data(),
+	}, nil
+}
+
+// readCachedDsn serves a cached DSN. Once the DSN is older than the cache TTL
+// it is served while being revalidated in the background until the stale window
+// runs out, after which it is revalidated before being served.
+func (b *backend) readCachedDsn(ctx context.Context, req *logical.Request, config *SentryOrg, project *SentryProject, dsn *SentryDsn) (*logical.Response, error) {
+	resp := &logical.Response{
+		Data: dsn.Data(),
+	}
+
+	if config == nil || config.DsnCacheTTL <= 0 {
+		return resp, nil
+	}
+
+	ttl := time.Duration(config.DsnCacheTTL) * time.Second
+	stale := time.Duration(config.DsnStaleIfError) * time.Second
+
+	// Entries cached before fetch times were recorded are treated as just expired
+	age := ttl
+	if !dsn.FetchedAt.IsZero() {
+		age = time.Since(dsn.FetchedAt)
+	}
+
+	if age < ttl {
+		return resp, nil
+	}
+
+	if age < ttl+stale {
+		if b.readOnly() {
+			if dsn.RevalidateError != "" {
+				resp.AddWarning(fmt.Sprintf("DSN %s could not be revalidated with sentry, serving the cached value. %s", dsn.Name, dsn.RevalidateError))
+			}
+
+			return resp, nil
+		}
+
+		// The read waits briefly for the revalidation so that a failing
+		// sentry is reported on the read that ran into it.
+		r := b.revalidateDsnInBackground(req.Storage, config, project, dsn)
+		select {
+		case <-r.done:
+			if r.err != nil {
+				resp.AddWarning(fmt.Sprintf("DSN %s could not be revalidated with sentry, serving the cached value. %s", dsn.Name, r.err))
+			} else if r.item != nil {
+				resp.Data = r.item.Data()
+			}
+		case <-time.After(revalidateWait):
+			resp.AddWarning(fmt.Sprintf("DSN %s could not be revalidated with sentry within %s, serving the cached value", dsn.Name, revalidateWait))
+		}
+
+		return resp, nil
+	}
+
+	if b.readOnly() {
+		return nil, logical.ErrReadOnly
+	}
+
+	lock := b.dsnLock(project.Name, dsn.Name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Another request may have revalidated the DSN while this one was waiting
+	current, err := loadDsn(ctx, req.Storage, project.Name, dsn.Name)
 	if err != nil {
 		return nil, err
 	}
 
+	if current != nil && current.FetchedAt.After(dsn.FetchedAt) {
+		return &logical.Response{
+			Data: current.Data(),
+		}, nil
+	}
+
+	item, err := b.revalidateDsn(ctx, req.Storage, config, project, dsn)
+	if err != nil {
+		return sentryErrorResponse(ctx, req, err, "failed to revalidate DSN %s with sentry", dsn.Name)
+	}
+
 	return &logical.Response{
 		Data: item.Data(),
 	}, nil
 }
 
-func fetchKeyOrMakeNew(client *sentry.Client, org sentry.Organization, project sentry.Project, label string) (*sentry.Key, error) {
-	keys, err := client.GetClientKeys(org, project)
+// revalidateWait is how long a read of a DSN in the stale window waits
+// for its revalidation before serving the cached value
+const revalidateWait = 2 * time.Second
+
+// revalidation is the revalidation of a cached DSN in the background.
+// item and err are set once done is closed.
+type revalidation struct {
+	done chan struct{}
+	item *SentryDsn
+	err  error
+}
+
+// revalidateDsnInBackground revalidates the DSN, or returns the revalidation
+// of the same label that is already in progress.
+func (b *backend) revalidateDsnInBackground(storage logical.Storage, config *SentryOrg, project *SentryProject, dsn *SentryDsn) *revalidation {
+	key := project.Name + "/" + dsn.Name
+	r := &revalidation{done: make(chan struct{})}
+	if running, ok := b.revalidating.LoadOrStore(key, r); ok {
+		return running.(*revalidation)
+	}
+
+	go func() {
+		defer close(r.done)
+		defer b.revalidating.Delete(key)
+
+		// The revalidation holds the lock of the label, so it is bound by the
+		// operation deadline and stops when the mount is unmounted
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if config.OperationTimeout > 0 {
+			ctx, cancel = context.WithTimeout(b.background, time.Duration(config.OperationTimeout)*time.Second)
+		} else {
+			ctx, cancel = context.WithCancel(b.background)
+		}
+
+		defer cancel()
+
+		lock := b.dsnLock(project.Name, dsn.Name)
+		lock.Lock()
+		defer lock.Unlock()
+
+		current, err := loadDsn(ctx, storage, project.Name, dsn.Name)
+		if err != nil {
+			r.err = err
+			return
+		}
+
+		// Skip labels that were deleted or refreshed in the meantime
+		if current == nil || current.FetchedAt.After(dsn.FetchedAt) {
+			r.item = current
+			return
+		}
+
+		r.item, r.err = b.revalidateDsn(ctx, storage, config, project, current)
+		if r.err != nil {
+			b.Logger().Warn("failed to revalidate DSN", "project", project.Name, "label", dsn.Name, "error", r.err)
+		}
+	}()
+
+	return r
+}
+
+// revalidateDsn refreshes the cached DSN from its sentry key. Failures are
+// recorded on the cached entry, and the entry is only removed when sentry
+// reports that the key no longer exists.
+func (b *backend) revalidateDsn(ctx context.Context, storage logical.Storage, config *SentryOrg, project *SentryProject, dsn *SentryDsn) (*SentryDsn, error) {
+	client, err := b.client(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var key *clientKey
+	err = b.withProject(ctx, storage, client, config, project, func(slug string) (err error) {
+		sentryOrg, sentryProject := sentry.Organization{Slug: &config.Name}, sentry.Project{Slug: &slug}
+		if dsn.KeyID != "" {
+			key, err = getClientKey(client, sentryOrg, sentryProject, dsn.KeyID)
+			return err
+		}
+
+		// Entries cached before key IDs were tracked are matched by label
+		keys, err := listClientKeys(client, sentryOrg, sentryProject)
+		if err != nil {
+			return err
+		}
+
+		for i := range keys {
+			if keys[i].Label == dsn.Name {
+				key = &keys[i]
+				return nil
+			}
+		}
+
+		return errClientKeyNotFound
+	})
+
+	if err != nil && dsn.KeyID != "" && isNotFound(err) {
+		err = storage.Delete(ctx, KeyDsnPrefix+project.Name+"/"+dsn.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("client key of DSN %s no longer exists in sentry", dsn.Name)
+	}
+
+	if err != nil {
+		failed := *dsn
+		failed.RevalidateError = err.Error()
+
+		if serr := storeDsn(ctx, storage, project.Name, dsn.Name, &failed); serr != nil {
+			return nil, serr
+		}
+
+		return nil, err
+	}
+
+	item := newSentryDsn(key)
+	item.Name = dsn.Name
+
+	err = storeDsn(ctx, storage, project.Name, dsn.Name, item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// storeKey caches the DSN of a key. A key that was created by this request is
+// deleted again if it can not be stored, because it would not be tracked.
+func (b *backend) storeKey(ctx context.Context, storage logical.Storage, config *SentryOrg, project *SentryProject, label string, key *clientKey) (*SentryDsn, error) {
+	item := newSentryDsn(key)
+
+	err := storeDsn(ctx, storage, project.Name, label, item)
+	if err != nil && key.created {
+		b.rollback(config, "client key "+key.ID, func(client *sentry.Client) error {
+			slug := project.slug()
+			return client.DeleteClientKey(sentry.Organization{Slug: &config.Name}, sentry.Project{Slug: &slug}, sentry.Key{ID: key.ID})
+		})
+	}
+
+	return item, err
+}
+
+// dsnLock returns the lock that serializes sentry operations on a DSN label
+func (b *backend) dsnLock(project, label string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.dsnLocks, project+"/"+label)
+}
+
+// storeDsn caches the DSN of the label and records keys that were
+// created by the plugin so that tidy can recognize them later.
+func storeDsn(ctx context.Context, storage logical.Storage, project, label string, item *SentryDsn) error {
+	entry, err := logical.StorageEntryJSON(KeyDsnPrefix+project+"/"+label, item)
+	if err != nil {
+		return err
+	}
+
+	err = storage.Put(ctx, entry)
+	if err != nil {
+		return err
+	}
+
+	if !item.created || item.KeyID == "" {
+		return nil
+	}
+
+	return storeCreatedKey(ctx, storage, &CreatedKey{
+		Project:     project,
+		Label:       label,
+		KeyID:       item.KeyID,
+		DateCreated: item.DateCreated,
+	})
+}
+
+// clientKey is a sentry client key along with the fields that
+// go-sentry-api does not decode.
+type clientKey struct {
+	sentry.Key
+	IsActive bool `json:"isActive"`
+
+	created bool
+}
+
+// listClientKeys returns every client key of the project
+func listClientKeys(client *sentry.Client, org sentry.Organization, project sentry.Project) ([]clientKey, error) {
+	var keys []clientKey
+	link, err := client.GetPage(sentry.Page{URL: fmt.Sprintf("projects/%s/%s/keys/", *org.Slug, *project.Slug)}, &keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for link != nil && link.Next.Results {
+		var page []clientKey
+		link, err = client.GetPage(link.Next, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, page...)
+	}
+
+	return keys, nil
+}
+
+// getClientKey returns the client key of the project with the given ID
+func getClientKey(client *sentry.Client, org sentry.Organization, project sentry.Project, keyID string) (*clientKey, error) {
+	key := new(clientKey)
+	err := sentryRequest(client, http.MethodGet, fmt.Sprintf("projects/%s/%s/keys/%s/", *org.Slug, *project.Slug, keyID), nil, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// errDsnNotFound is returned when a label does not exist in sentry and may not be created
+var errDsnNotFound = errors.New("DSN label does not exist")
+
+// dsnQuota is the number of DSN labels a project may have along with
+// the labels that are cached in Vault for the project.
+type dsnQuota struct {
+	max    int
+	cached []string
+}
+
+// loadDsnQuota returns the quota of the project. A limit set on the project
+// takes precedence over the mount limit, a limit of 0 means unlimited.
+func loadDsnQuota(ctx context.Context, storage logical.Storage, config *SentryOrg, project *SentryProject) (dsnQuota, error) {
+	quota := dsnQuota{max: config.MaxDsnLabels}
+	if project.MaxDsnLabels != nil {
+		quota.max = *project.MaxDsnLabels
+	}
+
+	if quota.max <= 0 {
+		return quota, nil
+	}
+
+	cached, err := storage.List(ctx, KeyDsnPrefix+project.Name+"/")
+	if err != nil {
+		return quota, err
+	}
+
+	quota.cached = cached
+	return quota, nil
+}
+
+// check returns an error if another label can not be created next to the sentry keys
+func (q dsnQuota) check(keys []clientKey) error {
+	if q.max <= 0 {
+		return nil
+	}
+
+	labels := append([]string{}, q.cached...)
+	for _, k := range keys {
+		labels = append(labels, k.Label)
+	}
+
+	labels = strutil.RemoveDuplicatesStable(labels, false)
+	if len(labels) < q.max {
+		return nil
+	}
+
+	sort.Strings(labels)
+	return fmt.Errorf("project reached the limit of %d DSN labels, existing labels are %s", q.max, strings.Join(labels, ", "))
+}
+
+// fetchKeyOrMakeNew returns the sentry key with the given label. When the key
+// does not exist it is created if create is set and the quota allows it,
+// otherwise errDsnNotFound is returned.
+func fetchKeyOrMakeNew(client *sentry.Client, org sentry.Organization, project sentry.Project, label string, create bool, quota dsnQuota) (*clientKey, error) {
+	keys, err := listClientKeys(client, org, project)
 	if err != nil {
 		return nil, err
 	}
@@ -129,10 +629,269 @@ func fetchKeyOrMakeNew(client *sentry.Client, org sentry.Organization, project s
 		}
 	}
 
+	if !create {
+		return nil, errDsnNotFound
+	}
+
+	err = quota.check(keys)
+	if err != nil {
+		return nil, err
+	}
+
 	key, err := client.CreateClientKey(org, project, label)
 	if err != nil {
 		return nil, err
 	}
 
-	return &key, nil
+	return &clientKey{Key: key, IsActive: true, created: true}, nil
+}
+
+func (b *backend) handleDsnList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	vaultProjectName := data.Get("project").(string)
+	includeSentry := data.Get("include_sentry").(bool)
+
+	vaultProject, err := loadProject(ctx, req.Storage, vaultProjectName)
+	if err != nil {
+		return nil, err
+	}
+
+	if vaultProject == nil {
+		return logical.ErrorResponse("project %s is not configured", vaultProjectName), nil
+	}
+
+	labels, err := req.Storage.List(ctx, KeyDsnPrefix+vaultProjectName+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(labels))
+	keyInfo := map[string]interface{}{}
+	tracked := map[string]bool{}
+
+	for _, label := range labels {
+		dsn, err := loadDsn(ctx, req.Storage, vaultProjectName, label)
+		if err != nil {
+			return nil, err
+		}
+
+		if dsn == nil {
+			continue
+		}
+
+		keys = append(keys, label)
+		keyInfo[label] = dsnKeyInfo(dsn, vaultProject, true)
+		tracked[dsn.KeyID] = true
+	}
+
+	if !includeSentry {
+		return logical.ListResponseWithInfo(keys, keyInfo), nil
+	}
+
+	config, err := loadConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return logical.ErrorResponse("plugin is not configured"), nil
+	}
+
+	client, err := b.client(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var sentryKeys []clientKey
+	err = b.withProject(ctx, req.Storage, client, config, vaultProject, func(slug string) (err error) {
+		sentryKeys, err = listClientKeys(client, sentry.Organization{Slug: &config.Name}, sentry.Project{Slug: &slug})
+		return err
+	})
+
+	if err != nil {
+		return sentryErrorResponse(ctx, req, err, "failed to retrieve client keys from sentry")
+	}
+
+	for _, k := range sentryKeys {
+		if tracked[k.ID] {
+			continue
+		}
+
+		// Entries cached before key IDs were tracked are matched by label
+		if info, ok := keyInfo[k.Label].(map[string]interface{}); ok && info["key_id"] == "" {
+			info["key_id"] = k.ID
+			info["active"] = k.IsActive
+			info["date_created"] = k.DateCreated.Format(time.RFC3339)
+			continue
+		}
+
+		name := k.Label
+		if _, ok := keyInfo[name]; ok || name == "" {
+			name = k.ID
+		}
+
+		keys = append(keys, name)
+		keyInfo[name] = dsnKeyInfo(newSentryDsn(&k), vaultProject, false)
+	}
+
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+func dsnKeyInfo(dsn *SentryDsn, project *SentryProject, cached bool) map[string]interface{} {
+	info := map[string]interface{}{
+		"key_id":       dsn.KeyID,
+		"active":       dsn.Active,
+		"date_created": "",
+		"is_default":   cached && dsn.Name == project.DefaultDsnLabel,
+		"cached":       cached,
+	}
+
+	if !dsn.DateCreated.IsZero() {
+		info["date_created"] = dsn.DateCreated.Format(time.RFC3339)
+	}
+
+	return info
+}
+
+func (b *backend) handleDsnDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	vaultProjectName := data.Get("project").(string)
+	dsnName := data.Get("name").(string)
+	sentryAction := data.Get("sentry_action").(string)
+	force := data.Get("force").(bool)
+
+	if dsnName == "" {
+		return logical.ErrorResponse("DSN label is required"), nil
+	}
+
+	switch sentryAction {
+	case "none", "delete", "disable":
+	default:
+		return logical.ErrorResponse("invalid sentry_action %q, must be one of none, delete or disable", sentryAction), nil
+	}
+
+	vaultProject, err := loadProject(ctx, req.Storage, vaultProjectName)
+	if err != nil {
+		return nil, err
+	}
+
+	if vaultProject == nil {
+		return logical.ErrorResponse("project %s is not configured", vaultProjectName), nil
+	}
+
+	if dsnName == vaultProject.DefaultDsnLabel && !force {
+		return logical.ErrorResponse("DSN %s is the default label of project %s, set force to delete it", dsnName, vaultProjectName), nil
+	}
+
+	lock := b.dsnLock(vaultProjectName, dsnName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	dsn, err := loadDsn(ctx, req.Storage, vaultProjectName, dsnName)
+	if err != nil {
+		return nil, err
+	}
+
+	if dsn == nil {
+		return logical.ErrorResponse("DSN %s is not configured for project %s", dsnName, vaultProjectName), nil
+	}
+
+	var warnings []string
+	if sentryAction != "none" {
+		config, err := loadConfig(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+
+		if config == nil {
+			return logical.ErrorResponse("plugin is not configured"), nil
+		}
+
+		client, err := b.client(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+
+		err = b.withProject(ctx, req.Storage, client, config, vaultProject, func(slug string) error {
+			return removeClientKey(client, config.Name, slug, dsn, sentryAction)
+		})
+
+		if errors.Is(err, errClientKeyNotFound) {
+			if !force {
+				return logical.ErrorResponse("client key of DSN %s could not be found in sentry, set force to remove the DSN from Vault anyway", dsnName), nil
+			}
+
+			warnings = append(warnings, fmt.Sprintf("client key of DSN %s could not be found in sentry and may still be active", dsnName))
+			err = nil
+		}
+
+		if err != nil {
+			return sentryErrorResponse(ctx, req, err, "failed to %s client key in sentry", sentryAction)
+		}
+
+		if sentryAction == "delete" && dsn.KeyID != "" {
+			err = req.Storage.Delete(ctx, KeyCreatedKeyPrefix+vaultProjectName+"/"+dsn.KeyID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = req.Storage.Delete(ctx, KeyDsnPrefix+vaultProjectName+"/"+dsnName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(warnings) > 0 {
+		return &logical.Response{
+			Warnings: warnings,
+		}, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "application/json",
+			logical.HTTPStatusCode:  http.StatusOK,
+		},
+	}, nil
+}
+
+// errClientKeyNotFound is returned when the sentry key of a DSN
+// that was cached without its key ID can not be found by label
+var errClientKeyNotFound = errors.New("client key not found")
+
+// removeClientKey deletes or disables the sentry key backing the DSN.
+// Keys that are known by ID and no longer exist in sentry are ignored.
+func removeClientKey(client *sentry.Client, org, project string, dsn *SentryDsn, action string) error {
+	keyID := dsn.KeyID
+
+	// Entries cached before key IDs were tracked are matched by label
+	if keyID == "" {
+		keys, err := listClientKeys(client, sentry.Organization{Slug: &org}, sentry.Project{Slug: &project})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if k.Label == dsn.Name {
+				keyID = k.ID
+				break
+			}
+		}
+	}
+
+	if keyID == "" {
+		return errClientKeyNotFound
+	}
+
+	var err error
+	if action == "delete" {
+		err = client.DeleteClientKey(sentry.Organization{Slug: &org}, sentry.Project{Slug: &project}, sentry.Key{ID: keyID})
+	} else {
+		err = sentryRequest(client, http.MethodPut, fmt.Sprintf("projects/%s/%s/keys/%s/", org, project, keyID), map[string]bool{"isActive": false}, nil)
+	}
+
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	return nil
 }
@@ -1,13 +1,20 @@
 package backend
 
 import (
+	"context"
 	"fmt"
+	"github.com/atlassian/go-sentry-api"
 	"github.com/google/go-cmp/cmp"
 	logicaltest "github.com/hashicorp/vault/helper/testhelpers/logical"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/logical"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHandleDsnRead(t *testing.T) {
@@ -29,6 +36,618 @@ func TestHandleDsnRead(t *testing.T) {
 	})
 }
 
+func TestHandleDsnAutoCreate(t *testing.T) {
+	org, project, team := "dsn-create-org", "create-app", "testers-team"
+
+	var created int32
+	localSentry.mux.HandleFunc(fmt.Sprintf("/projects/%s/display-name-%s/keys/", org, project), func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			atomic.AddInt32(&created, 1)
+			resp.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(resp, createClientKeyResponseBody, "created")
+			return
+		}
+
+		fmt.Fprintf(resp, getClientKeyResponseBody, "existing")
+	})
+
+	// Updates look the project up by the display name stored in Vault
+	localSentry.handleStatic(fmt.Sprintf("/projects/%s/display-name-%s/", org, project), http.StatusOK, fmt.Sprintf(getProjectResponseBody, "display-name-"+project))
+
+	checkCreated := func(count int32) error {
+		if n := atomic.LoadInt32(&created); n != count {
+			return fmt.Errorf("expected %d client keys to be created in sentry, got %d", count, n)
+		}
+
+		return nil
+	}
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		LogicalBackend: testGetBackend(t),
+		Steps: []logicaltest.TestStep{
+			testWriteConfig(org, "token", localSentry.url, 10),
+			testWriteProjectExisting(org, project, team, ""),
+			testReadDsnErr(project, "created", "DSN created does not exist for project create-app, write to the label to create it"),
+			{
+				Operation: logical.UpdateOperation,
+				Path:      "project/" + project,
+				Data: map[string]interface{}{
+					"team":                     team,
+					"dsn_allowed_labels_regex": "^(existing|created|auto)$",
+				},
+			},
+			testWriteDsnErr(project, "typo", "DSN label typo is not allowed for project create-app"),
+			testWriteDsn(project, "created"),
+			{
+				Operation: logical.ReadOperation,
+				Path:      "dsn/" + project + "/created",
+				Check: func(resp *logical.Response) error {
+					return checkCreated(1)
+				},
+			},
+			{
+				Operation: logical.UpdateOperation,
+				Path:      "project/" + project,
+				Data: map[string]interface{}{
+					"team":            team,
+					"dsn_auto_create": true,
+				},
+			},
+			{
+				Operation: logical.ReadOperation,
+				Path:      "dsn/" + project + "/auto",
+				Check: func(resp *logical.Response) error {
+					if resp.Data["dsn"] != "https://test@sentry.io/2" {
+						return fmt.Errorf("unexpected response to auto created DSN. %v", resp.Data)
+					}
+
+					return checkCreated(2)
+				},
+			},
+			{
+				// Labels the project does not allow are not created by reads
+				Operation: logical.ReadOperation,
+				Path:      "dsn/" + project + "/typo",
+				ErrorOk:   true,
+				Check: func(resp *logical.Response) error {
+					if !resp.IsError() || resp.Error().Error() != "DSN label typo is not allowed for project create-app" {
+						return fmt.Errorf("expected read of a disallowed label to fail, got %v", resp)
+					}
+
+					return checkCreated(2)
+				},
+			},
+		},
+	})
+}
+
+func TestHandleDsnQuota(t *testing.T) {
+	org, project, team := "dsn-quota-org", "quota-app", "testers-team"
+	localSentry.handleStatic(fmt.Sprintf("/projects/%s/display-name-%s/keys/", org, project), http.StatusOK, getClientKeysResponseBody)
+	localSentry.handleStatic(fmt.Sprintf("/projects/%s/%s/", org, project), http.StatusOK, fmt.Sprintf(getProjectResponseBody, "display-name-"+project))
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		LogicalBackend: testGetBackend(t),
+		Steps: []logicaltest.TestStep{
+			testWriteConfig(org, "token", localSentry.url, 10),
+			{
+				Operation: logical.UpdateOperation,
+				Path:      "project/" + project,
+				Data: map[string]interface{}{
+					"team":           team,
+					"max_dsn_labels": 2,
+				},
+			},
+			testWriteDsnErr(project, "third", "project reached the limit of 2 DSN labels, existing labels are primary, unmanaged"),
+			{
+				Operation: logical.UpdateOperation,
+				Path:      "dsn/" + project + "/primary",
+			},
+			testWriteQuotaErr("project/"+project, map[string]interface{}{"team": team, "max_dsn_labels": -1}),
+			testWriteQuotaErr("config", map[string]interface{}{"max_dsn_labels": -1}),
+		},
+	})
+}
+
+func testWriteQuotaErr(path string, data map[string]interface{}) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      path,
+		Data:      data,
+		ErrorOk:   true,
+		Check: func(resp *logical.Response) error {
+			if !resp.IsError() || !strings.Contains(resp.Error().Error(), "max_dsn_labels must not be negative") {
+				return fmt.Errorf("expected negative max_dsn_labels to be rejected on %s, got %v", path, resp)
+			}
+
+			return nil
+		},
+	}
+}
+
+func TestLoadDsnQuota(t *testing.T) {
+	unlimited, two := 0, 2
+	config := &SentryOrg{MaxDsnLabels: 5}
+
+	for _, tc := range []struct {
+		override *int
+		expect   int
+	}{
+		{nil, 5},
+		{&two, 2},
+		{&unlimited, 0},
+	} {
+		quota, err := loadDsnQuota(context.Background(), &logical.InmemStorage{}, config, &SentryProject{Name: "quota", MaxDsnLabels: tc.override})
+		if err != nil {
+			t.Fatalf("failed to load quota. %s", err)
+		}
+
+		if quota.max != tc.expect {
+			t.Errorf("expected limit %d for override %v, got %d", tc.expect, tc.override, quota.max)
+		}
+	}
+}
+
+func TestHandleDsnRevalidate(t *testing.T) {
+	org, healthy, failing := "dsn-revalidate-org", "healthy-app", "failing-app"
+	keysRoute := fmt.Sprintf("/projects/%s/display-name-%s/keys/", org, healthy)
+	localSentry.handleStatic(keysRoute, http.StatusOK, getClientKeysResponseBody)
+	localSentry.handleStatic(keysRoute+"cec9dfceb0b74c1c9a5e3c135585f364/", http.StatusOK, fmt.Sprintf(createClientKeyResponseBody, "primary"))
+	localSentry.handleStatic(keysRoute+"gone/", http.StatusNotFound, `{"detail": "The requested resource does not exist"}`)
+	localSentry.handleStatic(fmt.Sprintf("/projects/%s/display-name-%s/keys/", org, failing), http.StatusBadGateway, `{"detail": "bad gateway"}`)
+	localSentry.handleStatic(fmt.Sprintf("/organizations/%s/projects/", org), http.StatusOK, fmt.Sprintf(`[{"id": "2", "name": "display-name-%[1]s", "slug": "display-name-%[1]s"}]`, healthy))
+
+	ctx := context.Background()
+	b, storage := testGetBackendWithStorage(t)
+
+	seed := map[string]interface{}{
+		KeyConfig: &SentryOrg{Name: org, Endpoint: localSentry.url, ConnectionTimeout: 10, DsnCacheTTL: 3600, DsnStaleIfError: 86400},
+	}
+
+	for _, name := range []string{healthy, failing} {
+		seed[KeyProjectConfigPrefix+name] = &SentryProject{Name: name, DisplayName: "display-name-" + name, SentryID: "2", Slug: "display-name-" + name}
+		seed[KeyDsnPrefix+name+"/fresh"] = &SentryDsn{Name: "fresh", DSN: "https://fresh@sentry.io/2", FetchedAt: time.Now()}
+		seed[KeyDsnPrefix+name+"/stale"] = &SentryDsn{Name: "stale", DSN: "https://stale@sentry.io/2", FetchedAt: time.Now().Add(-2 * time.Hour)}
+		seed[KeyDsnPrefix+name+"/expired"] = &SentryDsn{Name: "expired", DSN: "https://expired@sentry.io/2", FetchedAt: time.Now().Add(-48 * time.Hour)}
+		seed[KeyDsnPrefix+name+"/primary"] = &SentryDsn{Name: "primary", DSN: "https://old@sentry.io/2", KeyID: "cec9dfceb0b74c1c9a5e3c135585f364", FetchedAt: time.Now().Add(-48 * time.Hour)}
+		seed[KeyDsnPrefix+name+"/deleted"] = &SentryDsn{Name: "deleted", DSN: "https://deleted@sentry.io/2", KeyID: "gone", FetchedAt: time.Now().Add(-48 * time.Hour)}
+	}
+
+	testSeedStorage(t, storage, seed)
+
+	read := func(project, label string) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "dsn/" + project + "/" + label,
+			Storage:   storage,
+		})
+
+		if err != nil {
+			t.Fatalf("failed to read DSN %s of %s. %s", label, project, err)
+		}
+
+		return resp
+	}
+
+	if resp := read(failing, "fresh"); resp.IsError() || len(resp.Warnings) > 0 || resp.Data["dsn"] != "https://fresh@sentry.io/2" {
+		t.Errorf("expected fresh DSN to be served from cache, got %v", resp)
+	}
+
+	if resp := read(healthy, "primary"); resp.IsError() || resp.Data["dsn"] != "https://test@sentry.io/2" {
+		t.Errorf("expected expired DSN to be revalidated, got %v", resp)
+	}
+
+	if resp := read(healthy, "expired"); !resp.IsError() {
+		t.Errorf("expected error for DSN whose key can not be found in sentry, got %v", resp)
+	}
+
+	if dsn, _ := loadDsn(ctx, storage, healthy, "expired"); dsn == nil {
+		t.Errorf("expected DSN matched by label to be kept when its key is not found")
+	}
+
+	if resp := read(healthy, "deleted"); !resp.IsError() {
+		t.Errorf("expected error for DSN whose key was removed from sentry, got %v", resp)
+	}
+
+	if dsn, _ := loadDsn(ctx, storage, healthy, "deleted"); dsn != nil {
+		t.Errorf("expected DSN whose key was removed from sentry to be deleted, got %+v", dsn)
+	}
+
+	if err := testSentryError(read(failing, "expired"), http.StatusBadGateway, "failed to revalidate DSN expired"); err != nil {
+		t.Errorf("expected revalidation error past the stale window. %s", err)
+	}
+
+	// The first read in the stale window already reports the failing sentry
+	resp := read(failing, "stale")
+	if resp.IsError() || resp.Data["dsn"] != "https://stale@sentry.io/2" || len(resp.Warnings) != 1 {
+		t.Errorf("expected stale DSN to be served with a warning, got %v", resp)
+	}
+
+	dsn, err := loadDsn(ctx, storage, failing, "stale")
+	if err != nil || dsn.RevalidateError == "" {
+		t.Errorf("expected revalidation failure to be recorded, got %+v %v", dsn, err)
+	}
+}
+
+func TestRevalidateDsnHungSentry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+
+	defer srv.Close()
+
+	ctx := context.Background()
+	project := &SentryProject{Name: "hung-app", SentryID: "2", Slug: "hung-app"}
+	dsn := &SentryDsn{Name: "primary", DSN: "https://primary@sentry.io/2", KeyID: "k1"}
+
+	wait := func(r *revalidation, within time.Duration) bool {
+		select {
+		case <-r.done:
+			return true
+		case <-time.After(within):
+			return false
+		}
+	}
+
+	// The operation deadline bounds the revalidation and releases the lock of the label
+	b, storage := testGetBackendWithStorage(t)
+	config := &SentryOrg{Name: "hung-org", Endpoint: srv.URL + "/", ConnectionTimeout: 30, OperationTimeout: 1}
+	testSeedStorage(t, storage, map[string]interface{}{KeyDsnPrefix + "hung-app/primary": dsn})
+
+	r := b.(*backend).revalidateDsnInBackground(storage, config, project, dsn)
+	if !wait(r, 5*time.Second) || r.err == nil || !strings.Contains(r.err.Error(), "deadline exceeded") {
+		t.Errorf("expected revalidation to fail at the operation deadline, got %v", r.err)
+	}
+
+	// Unmounting stops a revalidation that has no deadline
+	b, storage = testGetBackendWithStorage(t)
+	config.OperationTimeout = 0
+	testSeedStorage(t, storage, map[string]interface{}{KeyDsnPrefix + "hung-app/primary": dsn})
+
+	r = b.(*backend).revalidateDsnInBackground(storage, config, project, dsn)
+	if wait(r, 200*time.Millisecond) {
+		t.Fatalf("expected revalidation to wait for the hung sentry, got %v", r.err)
+	}
+
+	b.Cleanup(ctx)
+	if !wait(r, 5*time.Second) {
+		t.Errorf("expected revalidation to stop when the mount is unmounted")
+	}
+}
+
+func TestListClientKeysPaged(t *testing.T) {
+	org, project := "dsn-paged-org", "paged-app"
+	route := fmt.Sprintf("/projects/%s/%s/keys/", org, project)
+
+	localSentry.mux.HandleFunc(route, func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("cursor") == "" {
+			next := localSentry.url + strings.TrimPrefix(route, "/") + "?cursor=1"
+			resp.Header().Set("Link", fmt.Sprintf(`<%[1]s>; rel="previous"; results="false"; cursor="0", <%[1]s>; rel="next"; results="true"; cursor="1"`, next))
+			fmt.Fprint(resp, getClientKeysResponseBody)
+			return
+		}
+
+		fmt.Fprintf(resp, getClientKeyResponseBody, "second-page")
+	})
+
+	config := &SentryOrg{Name: org, Endpoint: localSentry.url, ConnectionTimeout: 10}
+	client, err := New(logical.TestBackendConfig()).client(context.Background(), config)
+	if err != nil {
+		t.Fatalf("failed to build client. %s", err)
+	}
+
+	keys, err := listClientKeys(client, sentry.Organization{Slug: &org}, sentry.Project{Slug: &project})
+	if err != nil {
+		t.Fatalf("failed to list client keys. %s", err)
+	}
+
+	var labels []string
+	for _, k := range keys {
+		labels = append(labels, k.Label)
+	}
+
+	if expect := []string{"primary", "unmanaged", "second-page"}; !cmp.Equal(expect, labels) {
+		t.Errorf("unexpected client keys. %s", cmp.Diff(expect, labels))
+	}
+}
+
+func TestHandleDsnConcurrentReads(t *testing.T) {
+	org, project := "dsn-concurrent-org", "fleet-app"
+
+	var created int32
+	localSentry.mux.HandleFunc(fmt.Sprintf("/projects/%s/display-name-%s/keys/", org, project), func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			atomic.AddInt32(&created, 1)
+			resp.WriteHeader(http.StatusCreated)
+			resp.Write([]byte(fmt.Sprintf(createClientKeyResponseBody, "fleet")))
+			return
+		}
+
+		resp.Write([]byte("[]"))
+	})
+
+	ctx := context.Background()
+	b, storage := testGetBackendWithStorage(t)
+	testSeedStorage(t, storage, map[string]interface{}{
+		KeyConfig:                        &SentryOrg{Name: org, Endpoint: localSentry.url, ConnectionTimeout: 10, DsnAutoCreate: true},
+		KeyProjectConfigPrefix + project: &SentryProject{Name: project, DisplayName: "display-name-" + project, SentryID: "2", Slug: "display-name-" + project},
+	})
+
+	var wg sync.WaitGroup
+	results := make([]*logical.Response, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "dsn/" + project + "/fleet",
+				Storage:   storage,
+			})
+		}(i)
+	}
+
+	wg.Wait()
+
+	if created != 1 {
+		t.Errorf("expected a single client key to be created, got %d", created)
+	}
+
+	for _, resp := range results {
+		if resp == nil || resp.IsError() || resp.Data["dsn"] != "https://test@sentry.io/2" {
+			t.Errorf("unexpected response to concurrent read. %v", resp)
+		}
+	}
+}
+
+func TestHandleDsnReadOnStandby(t *testing.T) {
+	org, project := "dsn-standby-org", "standby-app"
+
+	for _, state := range []consts.ReplicationState{consts.ReplicationPerformanceStandby, consts.ReplicationPerformanceSecondary} {
+		ctx := context.Background()
+		storage := &logical.InmemStorage{}
+		config := logical.TestBackendConfig()
+		config.StorageView = storage
+		config.System = &logical.StaticSystemView{ReplicationStateVal: state}
+
+		b, err := Factory(ctx, config)
+		if err != nil {
+			t.Fatalf("failed to initialize backend factory. %s", err)
+		}
+
+		testSeedStorage(t, storage, map[string]interface{}{
+			KeyConfig:                          &SentryOrg{Name: org, Endpoint: localSentry.url, ConnectionTimeout: 10, DsnAutoCreate: true},
+			KeyProjectConfigPrefix + project:   &SentryProject{Name: project, DisplayName: "display-name-" + project, SentryID: "2", Slug: "display-name-" + project},
+			KeyDsnPrefix + project + "/cached": &SentryDsn{Name: "cached", DSN: "https://cached@sentry.io/2", FetchedAt: time.Now()},
+		})
+
+		read := func(label string) (*logical.Response, error) {
+			return b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "dsn/" + project + "/" + label,
+				Storage:   storage,
+			})
+		}
+
+		if resp, err := read("cached"); err != nil || resp.Data["dsn"] != "https://cached@sentry.io/2" {
+			t.Errorf("expected cached DSN to be served on %s, got %v %v", state.GetPerformanceString(), resp, err)
+		}
+
+		// The sentry mock has no routes for the project, so any sentry call would fail the test
+		if _, err := read("missing"); err != logical.ErrReadOnly {
+			t.Errorf("expected cache miss to be forwarded on %s, got %v", state.GetPerformanceString(), err)
+		}
+
+		// Writes that create resources in sentry are forwarded before calling sentry
+		for _, path := range []string{"dsn/" + project + "/created", "monitors/" + project + "/nightly"} {
+			_, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      path,
+				Storage:   storage,
+			})
+
+			if err != logical.ErrReadOnly {
+				t.Errorf("expected write to %s to be forwarded on %s, got %v", path, state.GetPerformanceString(), err)
+			}
+		}
+	}
+}
+
+func testWriteDsn(project, dsnname string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "dsn/" + project + "/" + dsnname,
+		Check: func(resp *logical.Response) error {
+			expect := map[string]interface{}{
+				"name": dsnname,
+				"dsn":  "https://test@sentry.io/2",
+			}
+
+			if !cmp.Equal(expect, resp.Data) {
+				return fmt.Errorf("unexpected response. %s", cmp.Diff(expect, resp.Data))
+			}
+
+			return nil
+		},
+	}
+}
+
+func testWriteDsnErr(project, dsnname, msg string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "dsn/" + project + "/" + dsnname,
+		ErrorOk:   true,
+		Check: func(resp *logical.Response) error {
+			if !resp.IsError() {
+				return fmt.Errorf("expected error in response, got none")
+			}
+
+			if !strings.Contains(resp.Error().Error(), msg) {
+				return fmt.Errorf("unexpected error %q does not match %q", resp.Error(), msg)
+			}
+
+			return nil
+		},
+	}
+}
+
+func TestHandleDsnDelete(t *testing.T) {
+	org, project, team := "dsn-delete-org", "delete-app", "testers-team"
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		LogicalBackend: testGetBackend(t),
+		Steps: []logicaltest.TestStep{
+			testWriteConfig(org, "token", localSentry.url, 10),
+			testWriteProjectExisting(org, project, team, "primary"),
+			testReadDsn(org, project, "extra"),
+			testDeleteDsnErr(project, "primary", nil, "DSN primary is the default label of project delete-app, set force to delete it"),
+			testDeleteDsnErr(project, "extra", map[string]interface{}{"sentry_action": "revoke"}, "invalid sentry_action"),
+			testDeleteDsn(org, project, "extra", "delete"),
+			testDeleteDsnErr(project, "extra", nil, "DSN extra is not configured for project delete-app"),
+		},
+	})
+}
+
+func TestHandleDsnDeleteLegacyKey(t *testing.T) {
+	ctx := context.Background()
+	org, project := "dsn-delete-legacy-org", "legacy-app"
+	b, storage := testGetBackendWithStorage(t)
+
+	testSeedStorage(t, storage, map[string]interface{}{
+		KeyConfig:                          &SentryOrg{Name: org, Endpoint: localSentry.url, ConnectionTimeout: 10},
+		KeyProjectConfigPrefix + project:   &SentryProject{Name: project, DisplayName: project, SentryID: "2", Slug: project, DefaultDsnLabel: "primary"},
+		KeyDsnPrefix + project + "/orphan": &SentryDsn{Name: "orphan", DSN: "https://orphan@sentry.io/2"},
+	})
+
+	localSentry.handleStatic(fmt.Sprintf("/projects/%s/%s/keys/", org, project), http.StatusOK, getClientKeysResponseBody)
+
+	remove := func(force bool) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "dsn/" + project + "/orphan",
+			Storage:   storage,
+			Data:      map[string]interface{}{"sentry_action": "delete", "force": force},
+		})
+
+		if err != nil {
+			t.Fatalf("unexpected error on delete. %s", err)
+		}
+
+		return resp
+	}
+
+	resp := remove(false)
+	if !resp.IsError() || !strings.Contains(resp.Error().Error(), "could not be found in sentry, set force") {
+		t.Errorf("expected delete of an unresolved key to fail without force, got %v", resp)
+	}
+
+	if dsn, _ := loadDsn(ctx, storage, project, "orphan"); dsn == nil {
+		t.Errorf("expected DSN to be kept when its key can not be resolved")
+	}
+
+	resp = remove(true)
+	if resp == nil || resp.IsError() || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "may still be active") {
+		t.Errorf("expected forced delete to warn about the unresolved key, got %v", resp)
+	}
+
+	if dsn, _ := loadDsn(ctx, storage, project, "orphan"); dsn != nil {
+		t.Errorf("expected forced delete to remove the DSN, got %+v", dsn)
+	}
+}
+
+func TestHandleDsnList(t *testing.T) {
+	org, project, team := "dsn-list-org", "list-app", "testers-team"
+	localSentry.handleStatic(fmt.Sprintf("/projects/%s/display-name-%s/keys/", org, project), http.StatusOK, getClientKeysResponseBody)
+
+	cachedInfo := map[string]interface{}{
+		"key_id":       "cec9dfceb0b74c1c9a5e3c135585f364",
+		"active":       true,
+		"date_created": "2018-11-06T21:20:07Z",
+		"is_default":   true,
+		"cached":       true,
+	}
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		LogicalBackend: testGetBackend(t),
+		Steps: []logicaltest.TestStep{
+			testWriteConfig(org, "token", localSentry.url, 10),
+			testWriteProjectExisting(org, project, team, "primary"),
+			{
+				Operation: logical.ReadOperation,
+				Path:      "dsn/" + project,
+			},
+			testListDsn(project, false, []string{"primary"}, map[string]interface{}{
+				"primary": cachedInfo,
+			}),
+			testListDsn(project, true, []string{"primary", "unmanaged"}, map[string]interface{}{
+				"primary": cachedInfo,
+				"unmanaged": map[string]interface{}{
+					"key_id":       "60120449b6b1d5e45f75561e6dabd80b",
+					"active":       false,
+					"date_created": "2019-01-02T10:00:00Z",
+					"is_default":   false,
+					"cached":       false,
+				},
+			}),
+		},
+	})
+}
+
+func testListDsn(project string, includeSentry bool, keys []string, info map[string]interface{}) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ListOperation,
+		Path:      "dsn/" + project + "/",
+		Data: map[string]interface{}{
+			"include_sentry": includeSentry,
+		},
+		Check: func(resp *logical.Response) error {
+			if !cmp.Equal(keys, resp.Data["keys"]) {
+				return fmt.Errorf("unexpected list result. %s", cmp.Diff(keys, resp.Data["keys"]))
+			}
+
+			if !cmp.Equal(info, resp.Data["key_info"]) {
+				return fmt.Errorf("unexpected key info. %s", cmp.Diff(info, resp.Data["key_info"]))
+			}
+
+			return nil
+		},
+	}
+}
+
+func testDeleteDsn(org, project, dsnname, action string) logicaltest.TestStep {
+	localSentry.handleMethods(fmt.Sprintf("/projects/%s/display-name-%s/keys/cec9dfceb0b74c1c9a5e3c135585f364/", org, project), map[string]testResponse{
+		http.MethodDelete: {http.StatusNoContent, ""},
+	})
+
+	return logicaltest.TestStep{
+		Operation: logical.DeleteOperation,
+		Path:      "dsn/" + project + "/" + dsnname,
+		Data: map[string]interface{}{
+			"sentry_action": action,
+		},
+	}
+}
+
+func testDeleteDsnErr(project, dsnname string, data map[string]interface{}, msg string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.DeleteOperation,
+		Path:      "dsn/" + project + "/" + dsnname,
+		Data:      data,
+		ErrorOk:   true,
+		Check: func(resp *logical.Response) error {
+			if !resp.IsError() {
+				return fmt.Errorf("expected error in response, got none")
+			}
+
+			if !strings.Contains(resp.Error().Error(), msg) {
+				return fmt.Errorf("unexpected error %q does not match %q", resp.Error(), msg)
+			}
+
+			return nil
+		},
+	}
+}
+
 func testReadDsnErr(project, dsnname, msg string) logicaltest.TestStep {
 	return logicaltest.TestStep{
 		Operation: logical.ReadOperation,
@@ -113,3 +732,45 @@ const getClientKeyResponseBody = `
     "secret": "4f6a592349e249c5906918393766718d"
 }]
 `
+
+const getClientKeysResponseBody = `
+[{
+    "dateCreated": "2018-11-06T21:20:07.941Z",
+    "dsn": {
+      "public": "https://test@sentry.io/2",
+      "secret": "https://test-deprecated-dsn@sentry.io/2"
+    },
+    "id": "cec9dfceb0b74c1c9a5e3c135585f364",
+    "isActive": true,
+    "label": "primary",
+    "projectId": 2,
+    "public": "cec9dfceb0b74c1c9a5e3c135585f364"
+},
+{
+    "dateCreated": "2019-01-02T10:00:00.000Z",
+    "dsn": {
+      "public": "https://unmanaged@sentry.io/2",
+      "secret": "https://unmanaged-deprecated-dsn@sentry.io/2"
+    },
+    "id": "60120449b6b1d5e45f75561e6dabd80b",
+    "isActive": false,
+    "label": "unmanaged",
+    "projectId": 2,
+    "public": "60120449b6b1d5e45f75561e6dabd80b"
+}]
+`
+
+const createClientKeyResponseBody = `
+{
+    "dateCreated": "2020-03-01T10:00:00.000Z",
+    "dsn": {
+      "public": "https://test@sentry.io/2",
+      "secret": "https://test-deprecated-dsn@sentry.io/2"
+    },
+    "id": "d2b9d5a1a0e2489cb1c7c1c59a0e6c11",
+    "isActive": true,
+    "label": "%s",
+    "projectId": 2,
+    "public": "d2b9d5a1a0e2489cb1c7c1c59a0e6c11"
+}
+`
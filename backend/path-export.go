@@ -0,0 +1,379 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exportFormatVersion is the version of the export document format
+const exportFormatVersion = 1
+
+// StateExport is the state of the mount as it is exported. Entries are
+// stored as they are in storage, so the document is tied to the schema
+// version of the plugin that exported it.
+type StateExport struct {
+	FormatVersion int                              `json:"format_version"`
+	SchemaVersion int                              `json:"schema_version"`
+	ExportedAt    time.Time                        `json:"exported_at"`
+	Config        *SentryOrg                       `json:"config,omitempty"`
+	Projects      map[string]*SentryProject        `json:"projects"`
+	Dsns          map[string]map[string]*SentryDsn `json:"dsns"`
+}
+
+// importPlan is the outcome of an import, listing the storage keys
+// that are created, updated and deleted.
+type importPlan struct {
+	Mode    string
+	DryRun  bool
+	Created []string
+	Updated []string
+	Deleted []string
+}
+
+func (p *importPlan) Data() map[string]interface{} {
+	for _, keys := range [][]string{p.Created, p.Updated, p.Deleted} {
+		sort.Strings(keys)
+	}
+
+	return map[string]interface{}{
+		"mode":    p.Mode,
+		"dry_run": p.DryRun,
+		"created": p.Created,
+		"updated": p.Updated,
+		"deleted": p.Deleted,
+	}
+}
+
+func handleExport(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	includeToken := data.Get("include_token").(bool)
+
+	export := &StateExport{
+		FormatVersion: exportFormatVersion,
+		SchemaVersion: schemaVersion,
+		ExportedAt:    time.Now().UTC(),
+		Projects:      map[string]*SentryProject{},
+		Dsns:          map[string]map[string]*SentryDsn{},
+	}
+
+	config, err := loadConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config != nil && !includeToken {
+		config.ApiToken = ""
+		config.ClientKey = ""
+	}
+
+	export.Config = config
+
+	names, err := req.Storage.List(ctx, KeyProjectConfigPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		project, err := loadProject(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if project != nil {
+			export.Projects[name] = project
+		}
+	}
+
+	projects, err := req.Storage.List(ctx, KeyDsnPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range projects {
+		project := strings.TrimSuffix(dir, "/")
+
+		labels, err := req.Storage.List(ctx, KeyDsnPrefix+dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, label := range labels {
+			dsn, err := loadDsn(ctx, req.Storage, project, label)
+			if err != nil {
+				return nil, err
+			}
+
+			if dsn == nil {
+				continue
+			}
+
+			if export.Dsns[project] == nil {
+				export.Dsns[project] = map[string]*SentryDsn{}
+			}
+
+			export.Dsns[project][label] = dsn
+		}
+	}
+
+	document, err := json.Marshal(export)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"document": string(document),
+			"checksum": exportChecksum(string(document)),
+		},
+	}, nil
+}
+
+func (b *backend) handleImport(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	document := data.Get("document").(string)
+	checksum := data.Get("checksum").(string)
+	mode := data.Get("mode").(string)
+	dryRun := data.Get("dry_run").(bool)
+
+	if mode != "merge" && mode != "replace" {
+		return logical.ErrorResponse("invalid mode %s, must be merge or replace", mode), nil
+	}
+
+	if checksum != exportChecksum(document) {
+		return logical.ErrorResponse("checksum does not match the document"), nil
+	}
+
+	export := new(StateExport)
+	err := json.Unmarshal([]byte(document), export)
+	if err != nil {
+		return logical.ErrorResponse("failed to decode document. %s", err), nil
+	}
+
+	if export.FormatVersion != exportFormatVersion {
+		return logical.ErrorResponse("unsupported document format version %d", export.FormatVersion), nil
+	}
+
+	if export.SchemaVersion != schemaVersion {
+		return logical.ErrorResponse("document was exported with schema version %d, this plugin uses schema version %d", export.SchemaVersion, schemaVersion), nil
+	}
+
+	for name, project := range export.Projects {
+		if project == nil || project.Name != name || !validStorageName(name) {
+			return logical.ErrorResponse("project %q does not match its entry in the document", name), nil
+		}
+	}
+
+	for project, labels := range export.Dsns {
+		for label, dsn := range labels {
+			if dsn == nil || !validStorageName(project) || !validStorageName(label) {
+				return logical.ErrorResponse("DSN %q of project %q is not valid", label, project), nil
+			}
+		}
+	}
+
+	plan := &importPlan{Mode: mode, DryRun: dryRun, Created: []string{}, Updated: []string{}, Deleted: []string{}}
+	writes := map[string]interface{}{}
+
+	for name, project := range export.Projects {
+		writes[KeyProjectConfigPrefix+name] = project
+	}
+
+	for project, labels := range export.Dsns {
+		for label, dsn := range labels {
+			writes[KeyDsnPrefix+project+"/"+label] = dsn
+		}
+	}
+
+	var warnings []string
+	var config *SentryOrg
+	if export.Config != nil {
+		existing, err := loadConfig(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+
+		// A document exported without the token keeps the token of the mount
+		config = export.Config
+		if config.ApiToken == "" && existing != nil {
+			config.ApiToken = existing.ApiToken
+			config.ClientKey = existing.ClientKey
+			config.TokenChangedAt = existing.TokenChangedAt
+		}
+
+		if config.ApiToken == "" {
+			warnings = append(warnings, "document does not include the sentry API token, write it to config before using the mount")
+		}
+
+		writes[KeyConfig] = config
+	}
+
+	if mode == "replace" {
+		keys, err := importedKeys(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			if _, ok := writes[key]; !ok {
+				plan.Deleted = append(plan.Deleted, key)
+			}
+		}
+	}
+
+	keys := plan.Deleted
+	for key := range writes {
+		keys = append(keys, key)
+	}
+
+	unlock := b.lockImportedKeys(keys)
+	defer unlock()
+
+	for key := range writes {
+		entry, err := req.Storage.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry == nil {
+			plan.Created = append(plan.Created, key)
+			continue
+		}
+
+		plan.Updated = append(plan.Updated, key)
+
+		// A replaced project gets the next version, so that clients that
+		// read it before can not write over the import with check-and-set
+		if project, ok := writes[key].(*SentryProject); ok {
+			stored := new(SentryProject)
+			err = entry.DecodeJSON(stored)
+			if err != nil {
+				return nil, err
+			}
+
+			project.Version = stored.Version + 1
+		}
+	}
+
+	if dryRun {
+		return &logical.Response{
+			Data:     plan.Data(),
+			Warnings: warnings,
+		}, nil
+	}
+
+	for _, key := range plan.Deleted {
+		err = req.Storage.Delete(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for key, value := range writes {
+		if key == KeyConfig {
+			err = storeConfig(ctx, req.Storage, config)
+			if err != nil {
+				return nil, err
+			}
+
+			b.resetClient()
+			continue
+		}
+
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			return nil, err
+		}
+
+		err = req.Storage.Put(ctx, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b.Logger().Info("imported plugin state", "mode", mode, "created", len(plan.Created), "updated", len(plan.Updated), "deleted", len(plan.Deleted))
+
+	return &logical.Response{
+		Data:     plan.Data(),
+		Warnings: warnings,
+	}, nil
+}
+
+// importedKeys returns the storage keys of the projects and cached
+// DSN of the mount, which are replaced by an import.
+func importedKeys(ctx context.Context, storage logical.Storage) ([]string, error) {
+	var keys []string
+
+	names, err := storage.List(ctx, KeyProjectConfigPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		keys = append(keys, KeyProjectConfigPrefix+name)
+	}
+
+	projects, err := storage.List(ctx, KeyDsnPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range projects {
+		labels, err := storage.List(ctx, KeyDsnPrefix+dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, label := range labels {
+			keys = append(keys, KeyDsnPrefix+dir+label)
+		}
+	}
+
+	return keys, nil
+}
+
+// lockImportedKeys locks the projects and DSN of the storage keys so that
+// an import does not interleave with requests writing them. DSN locks are
+// taken before project locks, in the order DSN reads take them when they
+// refresh the project. The returned function releases the locks.
+func (b *backend) lockImportedKeys(keys []string) func() {
+	var dsns, projects []string
+	for _, key := range keys {
+		switch {
+		case strings.HasPrefix(key, KeyDsnPrefix):
+			dsns = append(dsns, strings.TrimPrefix(key, KeyDsnPrefix))
+		case strings.HasPrefix(key, KeyProjectConfigPrefix):
+			projects = append(projects, strings.TrimPrefix(key, KeyProjectConfigPrefix))
+		}
+	}
+
+	locks := append(locksutil.LocksForKeys(b.dsnLocks, dsns), locksutil.LocksForKeys(b.projectLocks, projects)...)
+	for _, lock := range locks {
+		lock.Lock()
+	}
+
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// validStorageName returns true if the name can be used
+// as a single segment of a storage key
+func validStorageName(name string) bool {
+	return name != "" && !strings.Contains(name, "/")
+}
+
+// exportChecksum detects documents that were corrupted or truncated on
+// their way between export and import. It is not keyed, so it does not
+// prove that the document was exported by a mount.
+func exportChecksum(document string) string {
+	sum := sha256.Sum256([]byte(document))
+	return hex.EncodeToString(sum[:])
+}
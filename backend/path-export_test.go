@@ -0,0 +1,182 @@
+package backend
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleExportImport(t *testing.T) {
+	ctx := context.Background()
+	source, sourceStorage := testGetBackendWithStorage(t)
+
+	testSeedStorage(t, sourceStorage, map[string]interface{}{
+		KeyConfigToken:                   &sentryOrgToken{Token: "source-token"},
+		KeyConfig:                        &SentryOrg{Name: "export-org", Endpoint: localSentry.url, ConnectionTimeout: 10},
+		KeyProjectConfigPrefix + "app":   &SentryProject{Name: "app", DisplayName: "App", SentryID: "4", Slug: "app", DefaultDsnLabel: "primary"},
+		KeyDsnPrefix + "app/primary":     &SentryDsn{Name: "primary", DSN: "https://primary@sentry.io/4", KeyID: "k1"},
+		KeyDsnPrefix + "app/secondary":   &SentryDsn{Name: "secondary", DSN: "https://secondary@sentry.io/4", KeyID: "k2"},
+		KeyMonitorPrefix + "app/nightly": &SentryMonitor{Project: "app", Slug: "nightly"},
+	})
+
+	resp, err := source.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "export",
+		Storage:   sourceStorage,
+	})
+
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to export. %v %v", resp, err)
+	}
+
+	document, checksum := resp.Data["document"].(string), resp.Data["checksum"].(string)
+	if strings.Contains(document, "source-token") {
+		t.Errorf("expected the token to be left out of the export")
+	}
+
+	target, storage := testGetBackendWithStorage(t)
+	testSeedStorage(t, storage, map[string]interface{}{
+		KeyConfigToken:                   &sentryOrgToken{Token: "target-token"},
+		KeyConfig:                        &SentryOrg{Name: "target-org", Endpoint: localSentry.url},
+		KeyProjectConfigPrefix + "other": &SentryProject{Name: "other"},
+		KeyDsnPrefix + "other/primary":   &SentryDsn{Name: "primary"},
+		KeyDsnPrefix + "app/primary":     &SentryDsn{Name: "primary", DSN: "https://stale@sentry.io/4"},
+	})
+
+	importState := func(dryRun bool, checksum string) (*logical.Response, error) {
+		return target.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "import",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"document": document,
+				"checksum": checksum,
+				"mode":     "replace",
+				"dry_run":  dryRun,
+			},
+		})
+	}
+
+	resp, err = importState(false, strings.Repeat("0", 64))
+	if err != nil || !resp.IsError() || resp.Error().Error() != "checksum does not match the document" {
+		t.Fatalf("expected document with wrong checksum to be rejected, got %v %v", resp, err)
+	}
+
+	expect := map[string]interface{}{
+		"mode":    "replace",
+		"created": []string{KeyDsnPrefix + "app/secondary", KeyProjectConfigPrefix + "app"},
+		"updated": []string{KeyConfig, KeyDsnPrefix + "app/primary"},
+		"deleted": []string{KeyDsnPrefix + "other/primary", KeyProjectConfigPrefix + "other"},
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		resp, err = importState(dryRun, checksum)
+		if err != nil || resp.IsError() {
+			t.Fatalf("failed to import with dry_run %t. %v %v", dryRun, resp, err)
+		}
+
+		expect["dry_run"] = dryRun
+		if dryRun {
+			if project, _ := loadProject(ctx, storage, "app"); project != nil {
+				t.Errorf("expected dry run to leave storage as is")
+			}
+		}
+
+		if !cmp.Equal(expect, resp.Data) {
+			t.Errorf("unexpected import plan with dry_run %t. %s", dryRun, cmp.Diff(expect, resp.Data))
+		}
+	}
+
+	config, err := loadConfig(ctx, storage)
+	if err != nil || config.Name != "export-org" || config.ApiToken != "target-token" {
+		t.Errorf("expected imported config to keep the token of the mount, got %v %v", config, err)
+	}
+
+	dsn, err := loadDsn(ctx, storage, "app", "primary")
+	if err != nil || dsn.DSN != "https://primary@sentry.io/4" {
+		t.Errorf("expected imported DSN to replace the cached one, got %v %v", dsn, err)
+	}
+
+	for _, key := range []string{KeyProjectConfigPrefix + "other", KeyDsnPrefix + "other/primary"} {
+		if entry, _ := storage.Get(ctx, key); entry != nil {
+			t.Errorf("expected %s to be deleted by replace", key)
+		}
+	}
+
+	// An import waits for requests that hold the lock of a DSN it writes
+	lock := target.(*backend).dsnLock("app", "primary")
+	lock.Lock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		importState(false, checksum)
+	}()
+
+	select {
+	case <-done:
+		t.Errorf("expected import to wait for the DSN lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	lock.Unlock()
+	<-done
+}
+
+func TestImportProjectVersion(t *testing.T) {
+	ctx := context.Background()
+	source, sourceStorage := testGetBackendWithStorage(t)
+
+	testSeedStorage(t, sourceStorage, map[string]interface{}{
+		KeyProjectConfigPrefix + "app": &SentryProject{Name: "app", SentryID: "4", Slug: "app", Version: 2},
+	})
+
+	resp, err := source.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "export",
+		Storage:   sourceStorage,
+	})
+
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to export. %v %v", resp, err)
+	}
+
+	target, storage := testGetBackendWithStorage(t)
+	testSeedStorage(t, storage, map[string]interface{}{
+		KeyProjectConfigPrefix + "app": &SentryProject{Name: "app", SentryID: "4", Slug: "app", DefaultDsnLabel: "primary", Version: 5},
+	})
+
+	resp, err = target.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "import",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"document": resp.Data["document"],
+			"checksum": resp.Data["checksum"],
+		},
+	})
+
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to import. %v %v", resp, err)
+	}
+
+	project, err := loadProject(ctx, storage, "app")
+	if err != nil || project.Version != 6 || project.DefaultDsnLabel != "" {
+		t.Errorf("expected the imported project to replace the stored one with the next version, got %v %v", project, err)
+	}
+
+	// A client that read the project before the import must not write over it
+	resp, err = target.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "project/app",
+		Storage:   storage,
+		Data:      map[string]interface{}{"team": "test-team", "cas": 5},
+	})
+
+	if err != nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "check-and-set parameter did not match the current version 6") {
+		t.Errorf("expected a stale check-and-set to be rejected after the import, got %v %v", resp, err)
+	}
+}
@@ -7,12 +7,30 @@ import (
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
-func handleInfoRead(context.Context, *logical.Request, *framework.FieldData) (*logical.Response, error) {
+func handleInfoRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	schema, err := loadSchemaStatus(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Details of a failed migration are only logged
+	// because info does not require authentication
+	migration := "complete"
+	switch {
+	case schema.Error != "":
+		migration = "failed"
+	case schema.Version < schemaVersion:
+		migration = "pending"
+	}
+
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"description": "Manage Sentry projects and their DSN",
-			"commit_sha":  version.GitCommit,
-			"version":     version.HumanVersion,
+			"description":           "Manage Sentry projects and their DSN",
+			"commit_sha":            version.GitCommit,
+			"version":               version.HumanVersion,
+			"schema_version":        schema.Version,
+			"target_schema_version": schemaVersion,
+			"migration_status":      migration,
 		},
 	}, nil
 }
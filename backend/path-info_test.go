@@ -26,9 +26,12 @@ func testReadInfo() logicaltest.TestStep {
 		Path:      "info",
 		Check: func(resp *logical.Response) error {
 			expect := map[string]interface{}{
-				"description": "Manage Sentry projects and their DSN",
-				"commit_sha":  version.GitCommit,
-				"version":     fmt.Sprintf(" v%s ()", version.Version),
+				"description":           "Manage Sentry projects and their DSN",
+				"commit_sha":            version.GitCommit,
+				"version":               fmt.Sprintf(" v%s ()", version.Version),
+				"schema_version":        schemaVersion,
+				"target_schema_version": schemaVersion,
+				"migration_status":      "complete",
 			}
 
 			if !cmp.Equal(expect, resp.Data) {
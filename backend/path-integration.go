@@ -0,0 +1,595 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/atlassian/go-sentry-api"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"time"
+)
+
+const (
+	KeyIntegrationPrefix      = "integrations/"
+	KeyIntegrationTokenPrefix = "integration-tokens/"
+)
+
+// SentryIntegration is an internal integration (Sentry App) managed by Vault
+type SentryIntegration struct {
+	Name           string    `json:"name"`
+	Slug           string    `json:"slug"`
+	UUID           string    `json:"uuid"`
+	Scopes         []string  `json:"scopes"`
+	Events         []string  `json:"events"`
+	WebhookURL     string    `json:"webhook_url"`
+	RotationPeriod int       `json:"rotation_period"`
+	LastRotated    time.Time `json:"last_rotated"`
+}
+
+func (i *SentryIntegration) Data() map[string]interface{} {
+	return map[string]interface{}{
+		"name":            i.Name,
+		"slug":            i.Slug,
+		"uuid":            i.UUID,
+		"scopes":          i.Scopes,
+		"events":          i.Events,
+		"webhook_url":     i.WebhookURL,
+		"rotation_period": i.RotationPeriod,
+		"last_rotated":    i.LastRotated.Format(time.RFC3339),
+	}
+}
+
+// rotationDue returns true if the integration token must be rotated at the given time
+func (i *SentryIntegration) rotationDue(now time.Time) bool {
+	if i.RotationPeriod <= 0 {
+		return false
+	}
+
+	return !now.Before(i.LastRotated.Add(time.Duration(i.RotationPeriod) * time.Second))
+}
+
+// SentryIntegrationToken is the API token of an internal integration. It is
+// stored apart from the integration so that it is only handed out by creds/.
+// PendingRevoke holds the IDs of previous tokens that are still to be revoked
+// in sentry. Tokens are revoked by their ID so that they never appear in URLs.
+type SentryIntegrationToken struct {
+	ID            string    `json:"id"`
+	Token         string    `json:"token"`
+	DateCreated   time.Time `json:"date_created"`
+	PendingRevoke []string  `json:"pending_revoke,omitempty"`
+}
+
+// sentryApp is the representation of an internal integration in the sentry API
+type sentryApp struct {
+	Name          string   `json:"name"`
+	Slug          string   `json:"slug,omitempty"`
+	UUID          string   `json:"uuid,omitempty"`
+	Organization  string   `json:"organization,omitempty"`
+	IsInternal    bool     `json:"isInternal"`
+	Scopes        []string `json:"scopes"`
+	Events        []string `json:"events"`
+	WebhookURL    string   `json:"webhookUrl,omitempty"`
+	VerifyInstall bool     `json:"verifyInstall"`
+}
+
+type sentryAppToken struct {
+	ID          string    `json:"id"`
+	Token       string    `json:"token"`
+	DateCreated time.Time `json:"dateCreated"`
+}
+
+func loadIntegration(ctx context.Context, storage logical.Storage, name string) (*SentryIntegration, error) {
+	entry, err := storage.Get(ctx, KeyIntegrationPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	item := new(SentryIntegration)
+	err = entry.DecodeJSON(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func loadIntegrationToken(ctx context.Context, storage logical.Storage, name string) (*SentryIntegrationToken, error) {
+	entry, err := storage.Get(ctx, KeyIntegrationTokenPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	item := new(SentryIntegrationToken)
+	err = entry.DecodeJSON(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// integrationLock returns the lock that serializes writes and token rotations of an integration
+func (b *backend) integrationLock(name string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.integrationLocks, name)
+}
+
+func storeIntegration(ctx context.Context, storage logical.Storage, item *SentryIntegration, token *SentryIntegrationToken) error {
+	entry, err := logical.StorageEntryJSON(KeyIntegrationPrefix+item.Name, item)
+	if err != nil {
+		return err
+	}
+
+	err = storage.Put(ctx, entry)
+	if err != nil {
+		return err
+	}
+
+	if token == nil {
+		return nil
+	}
+
+	entry, err = logical.StorageEntryJSON(KeyIntegrationTokenPrefix+item.Name, token)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
+}
+
+func handleIntegrationsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	items, err := req.Storage.List(ctx, KeyIntegrationPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(items), nil
+}
+
+func handleIntegrationRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	item, err := loadIntegration(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return logical.ErrorResponse("integration %s is not configured in Vault", name), nil
+	}
+
+	resp := &logical.Response{
+		Data: item.Data(),
+	}
+
+	if name == selfName {
+		resp.AddWarning(integrationSelfWarning)
+	}
+
+	return resp, nil
+}
+
+func (b *backend) handleIntegrationUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := b.integrationLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	config, err := loadConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return logical.ErrorResponse("plugin is not configured"), nil
+	}
+
+	item, err := loadIntegration(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		if name == selfName {
+			return logical.ErrorResponse("integration name %s is reserved for creds/self", selfName), nil
+		}
+
+		item = &SentryIntegration{Name: name}
+	}
+
+	if v, ok := data.GetOk("scopes"); ok {
+		item.Scopes = v.([]string)
+	}
+
+	if v, ok := data.GetOk("events"); ok {
+		item.Events = v.([]string)
+	}
+
+	if v, ok := data.GetOk("webhook_url"); ok {
+		item.WebhookURL = v.(string)
+	}
+
+	if v, ok := data.GetOk("rotation_period"); ok {
+		item.RotationPeriod = v.(int)
+	}
+
+	if item.Scopes == nil {
+		item.Scopes = []string{}
+	}
+
+	if item.Events == nil {
+		item.Events = []string{}
+	}
+
+	if len(item.Events) > 0 && item.WebhookURL == "" {
+		return logical.ErrorResponse("webhook_url is required when events are set"), nil
+	}
+
+	client, err := b.client(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	app := &sentryApp{
+		Name:         item.Name,
+		Organization: config.Name,
+		IsInternal:   true,
+		Scopes:       item.Scopes,
+		Events:       item.Events,
+		WebhookURL:   item.WebhookURL,
+	}
+
+	if item.Slug != "" {
+		err = sentryRequest(client, http.MethodPut, fmt.Sprintf("sentry-apps/%s/", item.Slug), app, app)
+		if err != nil {
+			return sentryErrorResponse(ctx, req, err, "failed to update integration in sentry")
+		}
+
+		err = storeIntegration(ctx, req.Storage, item, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return &logical.Response{
+			Data: item.Data(),
+		}, nil
+	}
+
+	err = sentryRequest(client, http.MethodPost, "sentry-apps/", app, app)
+	if err != nil {
+		return sentryErrorResponse(ctx, req, err, "failed to create integration in sentry")
+	}
+
+	item.Slug = app.Slug
+	item.UUID = app.UUID
+
+	// The integration is removed again if its token can not be stored
+	committed := false
+	defer func() {
+		if !committed {
+			b.rollback(config, "integration "+item.Slug, func(client *sentry.Client) error {
+				return sentryRequest(client, http.MethodDelete, fmt.Sprintf("sentry-apps/%s/", item.Slug), nil, nil)
+			})
+		}
+	}()
+
+	// Sentry issues a token when an internal integration is installed,
+	// adopt it instead of minting another one.
+	var tokens []sentryAppToken
+	err = sentryRequest(client, http.MethodGet, fmt.Sprintf("sentry-apps/%s/api-tokens/", item.Slug), nil, &tokens)
+	if err != nil {
+		return sentryErrorResponse(ctx, req, err, "failed to retrieve integration token from sentry")
+	}
+
+	var token sentryAppToken
+	if len(tokens) > 0 {
+		token = tokens[0]
+	} else {
+		err = sentryRequest(client, http.MethodPost, fmt.Sprintf("sentry-apps/%s/api-tokens/", item.Slug), nil, &token)
+		if err != nil {
+			return sentryErrorResponse(ctx, req, err, "failed to create integration token in sentry")
+		}
+	}
+
+	item.LastRotated = time.Now().UTC()
+	err = storeIntegration(ctx, req.Storage, item, &SentryIntegrationToken{
+		ID:          token.ID,
+		Token:       token.Token,
+		DateCreated: token.DateCreated,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	committed = true
+
+	return &logical.Response{
+		Data: item.Data(),
+	}, nil
+}
+
+func (b *backend) handleIntegrationDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := b.integrationLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	item, err := loadIntegration(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return logical.ErrorResponse("integration %s is not configured in vault", name), nil
+	}
+
+	config, err := loadConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return logical.ErrorResponse("plugin is not configured"), nil
+	}
+
+	client, err := b.client(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sentryRequest(client, http.MethodDelete, fmt.Sprintf("sentry-apps/%s/", item.Slug), nil, nil)
+	if err != nil && !isNotFound(err) {
+		return sentryErrorResponse(ctx, req, err, "failed to delete integration from sentry")
+	}
+
+	err = req.Storage.Delete(ctx, KeyIntegrationTokenPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = req.Storage.Delete(ctx, KeyIntegrationPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "application/json",
+			logical.HTTPStatusCode:  http.StatusOK,
+		},
+	}, nil
+}
+
+func (b *backend) handleIntegrationRotate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := b.integrationLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	item, err := loadIntegration(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return logical.ErrorResponse("integration %s is not configured in vault", name), nil
+	}
+
+	config, err := loadConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return logical.ErrorResponse("plugin is not configured"), nil
+	}
+
+	client, err := b.client(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings, err := rotateIntegrationToken(ctx, req.Storage, client, item)
+	if err != nil {
+		return sentryErrorResponse(ctx, req, err, "failed to rotate integration token")
+	}
+
+	return &logical.Response{
+		Data:     item.Data(),
+		Warnings: warnings,
+	}, nil
+}
+
+// rotateIntegrationToken creates a new token for the integration and stores
+// it before the previous token is revoked in sentry. The previous token is
+// kept on the token entry until its revocation succeeds, failures are
+// returned as warnings and retried later. The caller must hold the lock of
+// the integration.
+func rotateIntegrationToken(ctx context.Context, storage logical.Storage, client *sentry.Client, item *SentryIntegration) ([]string, error) {
+	previous, err := loadIntegrationToken(ctx, storage, item.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var token sentryAppToken
+	err = sentryRequest(client, http.MethodPost, fmt.Sprintf("sentry-apps/%s/api-tokens/", item.Slug), nil, &token)
+	if err != nil {
+		return nil, err
+	}
+
+	next := &SentryIntegrationToken{
+		ID:          token.ID,
+		Token:       token.Token,
+		DateCreated: token.DateCreated,
+	}
+
+	if previous != nil {
+		next.PendingRevoke = append(next.PendingRevoke, previous.PendingRevoke...)
+		if previous.ID != "" {
+			next.PendingRevoke = append(next.PendingRevoke, previous.ID)
+		}
+	}
+
+	item.LastRotated = time.Now().UTC()
+	err = storeIntegration(ctx, storage, item, next)
+	if err != nil {
+		return nil, err
+	}
+
+	return revokePendingTokens(ctx, storage, client, item, next)
+}
+
+// revokePendingTokens revokes the previous tokens of the integration in
+// sentry and drops the ones that were revoked from the token entry. The
+// caller must hold the lock of the integration.
+func revokePendingTokens(ctx context.Context, storage logical.Storage, client *sentry.Client, item *SentryIntegration, token *SentryIntegrationToken) ([]string, error) {
+	if len(token.PendingRevoke) == 0 {
+		return nil, nil
+	}
+
+	var warnings []string
+	var pending []string
+	for _, previous := range token.PendingRevoke {
+		err := sentryRequest(client, http.MethodDelete, fmt.Sprintf("sentry-apps/%s/api-tokens/%s/", item.Slug, previous), nil, nil)
+		if err == nil {
+			continue
+		}
+
+		// The token may have been revoked in sentry directly, or it may still be
+		// active under another ID. Either way retrying will not revoke it.
+		if isNotFound(err) {
+			warnings = append(warnings, fmt.Sprintf("previous token %s of integration %s was not found in sentry, make sure it is revoked", previous, item.Name))
+			continue
+		}
+
+		pending = append(pending, previous)
+		warnings = append(warnings, fmt.Sprintf("failed to revoke a previous token of integration %s, it is revoked again on the next rotation run. %s", item.Name, err))
+	}
+
+	if len(pending) == len(token.PendingRevoke) {
+		return warnings, nil
+	}
+
+	token.PendingRevoke = pending
+	return warnings, storeIntegration(ctx, storage, item, token)
+}
+
+// rotateDueIntegrations rotates the tokens of all integrations whose
+// rotation period has elapsed, and retries the revocation of previous
+// tokens that failed before.
+func (b *backend) rotateDueIntegrations(ctx context.Context, storage logical.Storage) error {
+	names, err := storage.List(ctx, KeyIntegrationPrefix)
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	config, err := loadConfig(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	if config == nil {
+		return nil
+	}
+
+	client, err := b.client(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = b.rotateDueIntegration(ctx, storage, client, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rotateDueIntegration rotates the token of a single integration if it
+// is due. Sentry failures are logged and do not stop the other integrations.
+func (b *backend) rotateDueIntegration(ctx context.Context, storage logical.Storage, client *sentry.Client, name string) error {
+	lock := b.integrationLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	item, err := loadIntegration(ctx, storage, name)
+	if err != nil || item == nil {
+		return err
+	}
+
+	var warnings []string
+	if item.rotationDue(time.Now().UTC()) {
+		warnings, err = rotateIntegrationToken(ctx, storage, client, item)
+		if err != nil {
+			b.Logger().Error("failed to rotate integration token", "integration", name, "error", err)
+			return nil
+		}
+
+		b.Logger().Info("rotated integration token", "integration", name)
+	} else {
+		token, err := loadIntegrationToken(ctx, storage, name)
+		if err != nil || token == nil {
+			return err
+		}
+
+		warnings, err = revokePendingTokens(ctx, storage, client, item, token)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, warning := range warnings {
+		b.Logger().Warn(warning)
+	}
+
+	return nil
+}
+
+func handleCredsRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	item, err := loadIntegration(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return logical.ErrorResponse("integration %s is not configured in Vault", name), nil
+	}
+
+	token, err := loadIntegrationToken(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if token == nil {
+		return logical.ErrorResponse("integration %s does not have a token", name), nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name":         item.Name,
+			"slug":         item.Slug,
+			"token":        token.Token,
+			"scopes":       item.Scopes,
+			"last_rotated": item.LastRotated.Format(time.RFC3339),
+		},
+	}, nil
+}
@@ -0,0 +1,281 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	logicaltest "github.com/hashicorp/vault/helper/testhelpers/logical"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHandleIntegration(t *testing.T) {
+	org, name, slug := "integration-org", "ci-bot", "ci-bot-a1b2c3"
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		LogicalBackend: testGetBackend(t),
+		Steps: []logicaltest.TestStep{
+			testWriteIntegrationErr(name, "plugin is not configured"),
+			testWriteConfig(org, "token", localSentry.url, 10),
+			testWriteIntegration(name, slug),
+			testReadIntegration(name, slug),
+			testReadCreds(name, "integration-token-1"),
+			testRotateIntegration(name),
+			testReadCreds(name, "integration-token-2"),
+			testListIntegrations(name),
+			testDeleteIntegration(name),
+			testReadCredsErr(name, "integration ci-bot is not configured in Vault"),
+		},
+	})
+}
+
+func TestIntegrationRevokeFailure(t *testing.T) {
+	ctx := context.Background()
+	name, slug := "revoke-bot", "revoke-bot-d4e5f6"
+	b, storage := testGetBackendWithStorage(t)
+
+	testSeedStorage(t, storage, map[string]interface{}{
+		KeyConfig:                        &SentryOrg{Name: "revoke-org", Endpoint: localSentry.url, ConnectionTimeout: 10},
+		KeyIntegrationPrefix + name:      &SentryIntegration{Name: name, Slug: slug},
+		KeyIntegrationTokenPrefix + name: &SentryIntegrationToken{ID: "id-old-token", Token: "old-token"},
+	})
+
+	localSentry.handleMethods("/sentry-apps/"+slug+"/api-tokens/", map[string]testResponse{
+		http.MethodPost: {http.StatusCreated, fmt.Sprintf(getSentryAppTokenResponseBody, "new-token")},
+	})
+
+	var revokeFails int32 = 1
+	localSentry.mux.HandleFunc("/sentry-apps/"+slug+"/api-tokens/id-old-token/", func(resp http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&revokeFails) == 1 {
+			resp.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		resp.WriteHeader(http.StatusNoContent)
+	})
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "integration/" + name + "/rotate",
+		Storage:   storage,
+	})
+
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected rotation to succeed when the revocation fails, got %v %v", resp, err)
+	}
+
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "failed to revoke a previous token") {
+		t.Errorf("expected a warning about the failed revocation, got %v", resp.Warnings)
+	}
+
+	token, err := loadIntegrationToken(ctx, storage, name)
+	if err != nil {
+		t.Fatalf("failed to load integration token. %s", err)
+	}
+
+	if token.Token != "new-token" || !cmp.Equal(token.PendingRevoke, []string{"id-old-token"}) {
+		t.Errorf("expected new token with the old token pending revocation, got %+v", token)
+	}
+
+	atomic.StoreInt32(&revokeFails, 0)
+	err = b.(*backend).rotateDueIntegrations(ctx, storage)
+	if err != nil {
+		t.Fatalf("unexpected error in periodic rotation. %s", err)
+	}
+
+	token, err = loadIntegrationToken(ctx, storage, name)
+	if err != nil {
+		t.Fatalf("failed to load integration token. %s", err)
+	}
+
+	if token.Token != "new-token" || len(token.PendingRevoke) != 0 {
+		t.Errorf("expected the old token to be revoked by the periodic run, got %+v", token)
+	}
+
+	// A previous token that sentry does not know is reported instead of being assumed revoked
+	localSentry.handleStatic("/sentry-apps/"+slug+"/api-tokens/id-new-token/", http.StatusNotFound, `{"detail": "The requested resource does not exist"}`)
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "integration/" + name + "/rotate",
+		Storage:   storage,
+	})
+
+	if err != nil || resp.IsError() {
+		t.Fatalf("expected rotation to succeed when the previous token is not found, got %v %v", resp, err)
+	}
+
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "previous token id-new-token of integration revoke-bot was not found") {
+		t.Errorf("expected a warning about the unknown previous token, got %v", resp.Warnings)
+	}
+}
+
+func testWriteIntegration(name, slug string) logicaltest.TestStep {
+	localSentry.handleMethods("/sentry-apps/", map[string]testResponse{
+		http.MethodPost: {http.StatusCreated, fmt.Sprintf(getSentryAppResponseBody, name, slug)},
+	})
+
+	localSentry.handleMethods("/sentry-apps/"+slug+"/", map[string]testResponse{
+		http.MethodPut:    {http.StatusOK, fmt.Sprintf(getSentryAppResponseBody, name, slug)},
+		http.MethodDelete: {http.StatusNoContent, ""},
+	})
+
+	localSentry.handleMethods("/sentry-apps/"+slug+"/api-tokens/", map[string]testResponse{
+		http.MethodGet:  {http.StatusOK, fmt.Sprintf("[%s]", fmt.Sprintf(getSentryAppTokenResponseBody, "integration-token-1"))},
+		http.MethodPost: {http.StatusCreated, fmt.Sprintf(getSentryAppTokenResponseBody, "integration-token-2")},
+	})
+
+	localSentry.handleMethods("/sentry-apps/"+slug+"/api-tokens/id-integration-token-1/", map[string]testResponse{
+		http.MethodDelete: {http.StatusNoContent, ""},
+	})
+
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "integration/" + name,
+		Data: map[string]interface{}{
+			"scopes":          "project:read,event:read",
+			"rotation_period": "24h",
+		},
+		Check: func(resp *logical.Response) error {
+			if resp.Data["slug"] != slug {
+				return fmt.Errorf("unexpected slug %q, expected %q", resp.Data["slug"], slug)
+			}
+
+			if _, ok := resp.Data["token"]; ok {
+				return fmt.Errorf("integration response must not contain the token")
+			}
+
+			return nil
+		},
+	}
+}
+
+func testWriteIntegrationErr(name, msg string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "integration/" + name,
+		ErrorOk:   true,
+		Data: map[string]interface{}{
+			"scopes": "project:read",
+		},
+		Check: func(resp *logical.Response) error {
+			if !resp.IsError() {
+				return fmt.Errorf("expected error in write response. got none")
+			}
+
+			if !strings.Contains(resp.Error().Error(), msg) {
+				return fmt.Errorf("unexpected error %q does not match %q", resp.Error(), msg)
+			}
+
+			return nil
+		},
+	}
+}
+
+func testReadIntegration(name, slug string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ReadOperation,
+		Path:      "integration/" + name,
+		Check: func(resp *logical.Response) error {
+			expect := map[string]interface{}{
+				"name":            name,
+				"slug":            slug,
+				"uuid":            "uuid-" + slug,
+				"scopes":          []string{"project:read", "event:read"},
+				"events":          []string{},
+				"webhook_url":     "",
+				"rotation_period": 86400,
+			}
+
+			delete(resp.Data, "last_rotated")
+			if !cmp.Equal(expect, resp.Data) {
+				return fmt.Errorf("unexpected data in read response. %s", cmp.Diff(expect, resp.Data))
+			}
+
+			return nil
+		},
+	}
+}
+
+func testRotateIntegration(name string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "integration/" + name + "/rotate",
+	}
+}
+
+func testReadCreds(name, token string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + name,
+		Check: func(resp *logical.Response) error {
+			if resp.Data["token"] != token {
+				return fmt.Errorf("unexpected token %q, expected %q", resp.Data["token"], token)
+			}
+
+			return nil
+		},
+	}
+}
+
+func testReadCredsErr(name, msg string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + name,
+		ErrorOk:   true,
+		Check: func(resp *logical.Response) error {
+			if !resp.IsError() {
+				return fmt.Errorf("expected error in read response, got none")
+			}
+
+			if !strings.Contains(resp.Error().Error(), msg) {
+				return fmt.Errorf("unexpected error message %q does not match %q", resp.Error(), msg)
+			}
+
+			return nil
+		},
+	}
+}
+
+func testListIntegrations(names ...string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ListOperation,
+		Path:      "integrations",
+		Check: func(resp *logical.Response) error {
+			if !cmp.Equal(names, resp.Data["keys"]) {
+				return fmt.Errorf("unexpected list result. %s", cmp.Diff(names, resp.Data))
+			}
+			return nil
+		},
+	}
+}
+
+func testDeleteIntegration(name string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.DeleteOperation,
+		Path:      "integration/" + name,
+	}
+}
+
+const getSentryAppResponseBody = `
+{
+  "name": "%[1]s",
+  "slug": "%[2]s",
+  "uuid": "uuid-%[2]s",
+  "status": "internal",
+  "scopes": ["project:read", "event:read"],
+  "events": []
+}
+`
+
+const getSentryAppTokenResponseBody = `
+{
+  "id": "id-%[1]s",
+  "token": "%[1]s",
+  "dateCreated": "2020-03-01T10:00:00.000Z",
+  "scopes": ["project:read", "event:read"]
+}
+`
@@ -0,0 +1,372 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/atlassian/go-sentry-api"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const KeyMonitorPrefix = "monitors/"
+
+// SentryMonitor is a cron monitor of a project managed by Vault
+type SentryMonitor struct {
+	Project       string `json:"project"`
+	Slug          string `json:"slug"`
+	Name          string `json:"name"`
+	Schedule      string `json:"schedule"`
+	Timezone      string `json:"timezone"`
+	CheckinMargin int    `json:"checkin_margin"`
+	MaxRuntime    int    `json:"max_runtime"`
+	DsnLabel      string `json:"dsn_label"`
+	CheckinURL    string `json:"checkin_url"`
+}
+
+func (m *SentryMonitor) Data() map[string]interface{} {
+	return map[string]interface{}{
+		"project":        m.Project,
+		"slug":           m.Slug,
+		"name":           m.Name,
+		"schedule":       m.Schedule,
+		"timezone":       m.Timezone,
+		"checkin_margin": m.CheckinMargin,
+		"max_runtime":    m.MaxRuntime,
+		"dsn_label":      m.DsnLabel,
+		"checkin_url":    m.CheckinURL,
+	}
+}
+
+// sentryMonitor is the representation of a cron monitor in the sentry API
+type sentryMonitor struct {
+	Project string              `json:"project"`
+	Name    string              `json:"name"`
+	Slug    string              `json:"slug"`
+	Type    string              `json:"type"`
+	Config  sentryMonitorConfig `json:"config"`
+}
+
+type sentryMonitorConfig struct {
+	ScheduleType  string `json:"schedule_type"`
+	Schedule      string `json:"schedule"`
+	Timezone      string `json:"timezone,omitempty"`
+	CheckinMargin int    `json:"checkin_margin,omitempty"`
+	MaxRuntime    int    `json:"max_runtime,omitempty"`
+}
+
+// monitorCheckinURL builds the check-in URL of a monitor from a public DSN
+// of the form scheme://public_key@host/project_id.
+func monitorCheckinURL(dsn, slug string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+
+	if u.User == nil || u.User.Username() == "" {
+		return "", fmt.Errorf("DSN does not contain a public key")
+	}
+
+	path := strings.Trim(u.Path, "/")
+	idx := strings.LastIndex(path, "/")
+
+	prefix, projectID := "", path
+	if idx >= 0 {
+		prefix, projectID = "/"+path[:idx], path[idx+1:]
+	}
+
+	if projectID == "" {
+		return "", fmt.Errorf("DSN does not contain a project ID")
+	}
+
+	return fmt.Sprintf("%s://%s%s/api/%s/cron/%s/%s/", u.Scheme, u.Host, prefix, projectID, slug, u.User.Username()), nil
+}
+
+func loadMonitor(ctx context.Context, storage logical.Storage, project, slug string) (*SentryMonitor, error) {
+	entry, err := storage.Get(ctx, KeyMonitorPrefix+project+"/"+slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	item := new(SentryMonitor)
+	err = entry.DecodeJSON(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func handleMonitorsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	projectName := data.Get("project").(string)
+	items, err := req.Storage.List(ctx, KeyMonitorPrefix+projectName+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(items), nil
+}
+
+func handleMonitorRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	projectName := data.Get("project").(string)
+	slug := data.Get("slug").(string)
+
+	item, err := loadMonitor(ctx, req.Storage, projectName, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return logical.ErrorResponse("monitor %s is not configured for project %s", slug, projectName), nil
+	}
+
+	return &logical.Response{
+		Data: item.Data(),
+	}, nil
+}
+
+func (b *backend) handleMonitorUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// The monitor could not be stored here, let the active node write it
+	if b.readOnly() {
+		return nil, logical.ErrReadOnly
+	}
+
+	projectName := data.Get("project").(string)
+	slug := data.Get("slug").(string)
+
+	vaultProject, err := loadProject(ctx, req.Storage, projectName)
+	if err != nil {
+		return nil, err
+	}
+
+	if vaultProject == nil {
+		return logical.ErrorResponse("project %s is not configured", projectName), nil
+	}
+
+	config, err := loadConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return logical.ErrorResponse("plugin is not configured"), nil
+	}
+
+	existing, err := loadMonitor(ctx, req.Storage, projectName, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	item := existing
+	if item == nil {
+		item = &SentryMonitor{
+			Project:  projectName,
+			Slug:     slug,
+			Name:     slug,
+			Timezone: "UTC",
+		}
+	}
+
+	if v, ok := data.GetOk("name"); ok {
+		item.Name = v.(string)
+	}
+
+	if v, ok := data.GetOk("schedule"); ok {
+		item.Schedule = v.(string)
+	}
+
+	if v, ok := data.GetOk("timezone"); ok {
+		item.Timezone = v.(string)
+	}
+
+	if v, ok := data.GetOk("checkin_margin"); ok {
+		item.CheckinMargin = v.(int)
+	}
+
+	if v, ok := data.GetOk("max_runtime"); ok {
+		item.MaxRuntime = v.(int)
+	}
+
+	if v, ok := data.GetOk("dsn_label"); ok {
+		item.DsnLabel = v.(string)
+	}
+
+	if item.Schedule == "" {
+		return logical.ErrorResponse("schedule is required"), nil
+	}
+
+	dsnLabel := item.DsnLabel
+	if dsnLabel == "" {
+		dsnLabel = vaultProject.DefaultDsnLabel
+	}
+
+	if dsnLabel == "" {
+		return logical.ErrorResponse("dsn_label is required when default DSN label is not set for project %s", projectName), nil
+	}
+
+	if !vaultProject.dsnLabelAllowed(dsnLabel) {
+		return logical.ErrorResponse("DSN label %s is not allowed for project %s", dsnLabel, projectName), nil
+	}
+
+	client, err := b.client(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := b.dsnLock(projectName, dsnLabel)
+	lock.Lock()
+	defer lock.Unlock()
+
+	dsn, err := loadDsn(ctx, req.Storage, projectName, dsnLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	if dsn == nil {
+		quota, err := loadDsnQuota(ctx, req.Storage, config, vaultProject)
+		if err != nil {
+			return nil, err
+		}
+
+		var key *clientKey
+		err = b.withProject(ctx, req.Storage, client, config, vaultProject, func(slug string) (err error) {
+			key, err = fetchKeyOrMakeNew(
+				client,
+				sentry.Organization{Slug: &config.Name},
+				sentry.Project{Slug: &slug},
+				dsnLabel,
+				true,
+				quota,
+			)
+
+			return err
+		})
+
+		if err != nil {
+			return sentryErrorResponse(ctx, req, err, "failed to retrieve client keys from sentry")
+		}
+
+		dsn, err = b.storeKey(ctx, req.Storage, config, vaultProject, dsnLabel, key)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Sentry rejects monitors of an unknown project as invalid rather than
+		// not found, so the slug is checked first to follow a renamed project
+		err = b.withProject(ctx, req.Storage, client, config, vaultProject, func(slug string) error {
+			return sentryRequest(client, http.MethodGet, fmt.Sprintf("projects/%s/%s/", config.Name, slug), nil, nil)
+		})
+
+		if err != nil {
+			return sentryErrorResponse(ctx, req, err, "failed to retrieve project details from sentry")
+		}
+	}
+
+	checkinURL, err := monitorCheckinURL(dsn.DSN, slug)
+	if err != nil {
+		return logical.ErrorResponse("failed to build check-in URL from DSN %s. %s", dsnLabel, err), nil
+	}
+
+	monitor := &sentryMonitor{
+		Project: vaultProject.slug(),
+		Name:    item.Name,
+		Slug:    slug,
+		Type:    "cron_job",
+		Config: sentryMonitorConfig{
+			ScheduleType:  "crontab",
+			Schedule:      item.Schedule,
+			Timezone:      item.Timezone,
+			CheckinMargin: item.CheckinMargin,
+			MaxRuntime:    item.MaxRuntime,
+		},
+	}
+
+	if existing == nil {
+		err = sentryRequest(client, http.MethodPost, fmt.Sprintf("organizations/%s/monitors/", config.Name), monitor, nil)
+	} else {
+		err = sentryRequest(client, http.MethodPut, fmt.Sprintf("organizations/%s/monitors/%s/", config.Name, slug), monitor, nil)
+	}
+
+	if err != nil {
+		return sentryErrorResponse(ctx, req, err, "failed to save monitor in sentry")
+	}
+
+	// A monitor created by this request is removed again if it can not be stored
+	committed := false
+	defer func() {
+		if existing == nil && !committed {
+			b.rollback(config, "monitor "+slug, func(client *sentry.Client) error {
+				return sentryRequest(client, http.MethodDelete, fmt.Sprintf("organizations/%s/monitors/%s/", config.Name, slug), nil, nil)
+			})
+		}
+	}()
+
+	item.CheckinURL = checkinURL
+
+	entry, err := logical.StorageEntryJSON(KeyMonitorPrefix+projectName+"/"+slug, item)
+	if err != nil {
+		return nil, err
+	}
+
+	err = req.Storage.Put(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	committed = true
+
+	return &logical.Response{
+		Data: item.Data(),
+	}, nil
+}
+
+func (b *backend) handleMonitorDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	projectName := data.Get("project").(string)
+	slug := data.Get("slug").(string)
+
+	item, err := loadMonitor(ctx, req.Storage, projectName, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return logical.ErrorResponse("monitor %s is not configured for project %s", slug, projectName), nil
+	}
+
+	config, err := loadConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return logical.ErrorResponse("plugin is not configured"), nil
+	}
+
+	client, err := b.client(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sentryRequest(client, http.MethodDelete, fmt.Sprintf("organizations/%s/monitors/%s/", config.Name, slug), nil, nil)
+	if err != nil && !isNotFound(err) {
+		return sentryErrorResponse(ctx, req, err, "failed to delete monitor from sentry")
+	}
+
+	err = req.Storage.Delete(ctx, KeyMonitorPrefix+projectName+"/"+slug)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "application/json",
+			logical.HTTPStatusCode:  http.StatusOK,
+		},
+	}, nil
+}
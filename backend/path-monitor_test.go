@@ -0,0 +1,221 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	logicaltest "github.com/hashicorp/vault/helper/testhelpers/logical"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleMonitor(t *testing.T) {
+	org, project, team, label, slug := "monitor-org", "nightly-jobs", "jobs-team", "cron", "db-backup"
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		LogicalBackend: testGetBackend(t),
+		Steps: []logicaltest.TestStep{
+			testWriteMonitorErr(project, slug, "project nightly-jobs is not configured"),
+			testWriteConfig(org, "token", localSentry.url, 10),
+			testWriteProjectExisting(org, project, team, label),
+			testWriteMonitor(org, project, label, slug),
+			testReadMonitor(project, slug),
+			testListMonitors(project, slug),
+			testDeleteMonitor(project, slug),
+			testReadMonitorErr(project, slug, "monitor db-backup is not configured for project nightly-jobs"),
+		},
+	})
+}
+
+func TestHandleMonitorRenamedProject(t *testing.T) {
+	org := "monitor-rename-org"
+
+	localSentry.handleStatic("/organizations/"+org+"/projects/", http.StatusOK, `[{"id": "7", "name": "Jobs", "slug": "new-jobs"}]`)
+	localSentry.handleStatic("/projects/"+org+"/old-jobs/", http.StatusNotFound, `{"detail": "The requested resource does not exist"}`)
+	localSentry.handleStatic("/projects/"+org+"/new-jobs/", http.StatusOK, "{}")
+
+	var monitor sentryMonitor
+	localSentry.mux.HandleFunc("/organizations/"+org+"/monitors/", func(resp http.ResponseWriter, req *http.Request) {
+		if err := json.NewDecoder(req.Body).Decode(&monitor); err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		resp.WriteHeader(http.StatusCreated)
+		resp.Write([]byte("{}"))
+	})
+
+	ctx := context.Background()
+	b, storage := testGetBackendWithStorage(t)
+
+	testSeedStorage(t, storage, map[string]interface{}{
+		KeyConfig:                       &SentryOrg{Name: org, Endpoint: localSentry.url, ConnectionTimeout: 10},
+		KeyProjectConfigPrefix + "jobs": &SentryProject{Name: "jobs", DisplayName: "Jobs", SentryID: "7", Slug: "old-jobs", Version: 1},
+		KeyDsnPrefix + "jobs/cron":      &SentryDsn{Name: "cron", DSN: "https://public@sentry.io/7", FetchedAt: time.Now()},
+	})
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "monitors/jobs/nightly",
+		Storage:   storage,
+		Data:      map[string]interface{}{"schedule": "0 3 * * *", "dsn_label": "cron"},
+	})
+
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to write monitor of a renamed project. %v %v", resp, err)
+	}
+
+	if monitor.Project != "new-jobs" {
+		t.Errorf("expected the monitor to be created in the renamed project, got %q", monitor.Project)
+	}
+
+	project, err := loadProject(ctx, storage, "jobs")
+	if err != nil || project.Slug != "new-jobs" {
+		t.Errorf("expected the new slug of the project to be stored, got %v %v", project, err)
+	}
+}
+
+func TestMonitorCheckinURL(t *testing.T) {
+	cases := map[string]string{
+		"https://public@o1.ingest.sentry.io/42":       "https://o1.ingest.sentry.io/api/42/cron/job/public/",
+		"https://public@sentry.example.com/sentry/7":  "https://sentry.example.com/sentry/api/7/cron/job/public/",
+		"http://public@localhost:9000/3":              "http://localhost:9000/api/3/cron/job/public/",
+		"https://public@sentry.example.com/sentry/7/": "https://sentry.example.com/sentry/api/7/cron/job/public/",
+	}
+
+	for dsn, expect := range cases {
+		got, err := monitorCheckinURL(dsn, "job")
+		if err != nil {
+			t.Fatalf("unexpected error for %s. %s", dsn, err)
+		}
+
+		if got != expect {
+			t.Errorf("unexpected check-in URL for %s. expected %q, got %q", dsn, expect, got)
+		}
+	}
+
+	if _, err := monitorCheckinURL("https://sentry.io/42", "job"); err == nil {
+		t.Errorf("expected error for DSN without public key")
+	}
+}
+
+func testWriteMonitor(org, project, label, slug string) logicaltest.TestStep {
+	localSentry.handleStatic(fmt.Sprintf("/projects/%s/display-name-%s/keys/", org, project), http.StatusOK, fmt.Sprintf(getClientKeyResponseBody, label))
+	localSentry.handleMethods(fmt.Sprintf("/organizations/%s/monitors/", org), map[string]testResponse{
+		http.MethodPost: {http.StatusCreated, "{}"},
+	})
+
+	localSentry.handleMethods(fmt.Sprintf("/organizations/%s/monitors/%s/", org, slug), map[string]testResponse{
+		http.MethodPut:    {http.StatusOK, "{}"},
+		http.MethodDelete: {http.StatusAccepted, ""},
+	})
+
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "monitors/" + project + "/" + slug,
+		Data: map[string]interface{}{
+			"schedule":       "0 3 * * *",
+			"checkin_margin": 5,
+			"max_runtime":    30,
+		},
+		Check: func(resp *logical.Response) error {
+			expect := "https://sentry.io/api/2/cron/" + slug + "/test/"
+			if resp.Data["checkin_url"] != expect {
+				return fmt.Errorf("unexpected check-in URL %q, expected %q", resp.Data["checkin_url"], expect)
+			}
+
+			return nil
+		},
+	}
+}
+
+func testWriteMonitorErr(project, slug, msg string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "monitors/" + project + "/" + slug,
+		ErrorOk:   true,
+		Data: map[string]interface{}{
+			"schedule": "0 3 * * *",
+		},
+		Check: func(resp *logical.Response) error {
+			if !resp.IsError() {
+				return fmt.Errorf("expected error in write response. got none")
+			}
+
+			if !strings.Contains(resp.Error().Error(), msg) {
+				return fmt.Errorf("unexpected error %q does not match %q", resp.Error(), msg)
+			}
+
+			return nil
+		},
+	}
+}
+
+func testReadMonitor(project, slug string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ReadOperation,
+		Path:      "monitors/" + project + "/" + slug,
+		Check: func(resp *logical.Response) error {
+			expect := map[string]interface{}{
+				"project":        project,
+				"slug":           slug,
+				"name":           slug,
+				"schedule":       "0 3 * * *",
+				"timezone":       "UTC",
+				"checkin_margin": 5,
+				"max_runtime":    30,
+				"dsn_label":      "",
+				"checkin_url":    "https://sentry.io/api/2/cron/" + slug + "/test/",
+			}
+
+			if !cmp.Equal(expect, resp.Data) {
+				return fmt.Errorf("unexpected data in read response. %s", cmp.Diff(expect, resp.Data))
+			}
+
+			return nil
+		},
+	}
+}
+
+func testReadMonitorErr(project, slug, msg string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ReadOperation,
+		Path:      "monitors/" + project + "/" + slug,
+		ErrorOk:   true,
+		Check: func(resp *logical.Response) error {
+			if !resp.IsError() {
+				return fmt.Errorf("expected error in read response, got none")
+			}
+
+			if !strings.Contains(resp.Error().Error(), msg) {
+				return fmt.Errorf("unexpected error message %q does not match %q", resp.Error(), msg)
+			}
+
+			return nil
+		},
+	}
+}
+
+func testListMonitors(project string, slugs ...string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ListOperation,
+		Path:      "monitors/" + project,
+		Check: func(resp *logical.Response) error {
+			if !cmp.Equal(slugs, resp.Data["keys"]) {
+				return fmt.Errorf("unexpected list result. %s", cmp.Diff(slugs, resp.Data))
+			}
+			return nil
+		},
+	}
+}
+
+func testDeleteMonitor(project, slug string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.DeleteOperation,
+		Path:      "monitors/" + project + "/" + slug,
+	}
+}
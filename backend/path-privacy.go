@@ -0,0 +1,482 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/atlassian/go-sentry-api"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	KeyPrivacyPolicy = "config/privacy"
+	KeyPrivacyStatus = "privacy/status"
+)
+
+// PrivacySettings are the data scrubbing settings of a sentry project.
+// Unset fields are left untouched in sentry.
+type PrivacySettings struct {
+	DataScrubber         *bool     `json:"data_scrubber,omitempty"`
+	DataScrubberDefaults *bool     `json:"data_scrubber_defaults,omitempty"`
+	ScrubIPAddresses     *bool     `json:"scrub_ip_addresses,omitempty"`
+	SensitiveFields      *[]string `json:"sensitive_fields,omitempty"`
+	SafeFields           *[]string `json:"safe_fields,omitempty"`
+}
+
+func (s *PrivacySettings) Data() map[string]interface{} {
+	data := map[string]interface{}{}
+	if s.DataScrubber != nil {
+		data["data_scrubber"] = *s.DataScrubber
+	}
+
+	if s.DataScrubberDefaults != nil {
+		data["data_scrubber_defaults"] = *s.DataScrubberDefaults
+	}
+
+	if s.ScrubIPAddresses != nil {
+		data["scrub_ip_addresses"] = *s.ScrubIPAddresses
+	}
+
+	if s.SensitiveFields != nil {
+		data["sensitive_fields"] = *s.SensitiveFields
+	}
+
+	if s.SafeFields != nil {
+		data["safe_fields"] = *s.SafeFields
+	}
+
+	return data
+}
+
+// merge returns the settings with the fields that are set in override replaced
+func (s *PrivacySettings) merge(override *PrivacySettings) *PrivacySettings {
+	merged := *s
+	if override == nil {
+		return &merged
+	}
+
+	if override.DataScrubber != nil {
+		merged.DataScrubber = override.DataScrubber
+	}
+
+	if override.DataScrubberDefaults != nil {
+		merged.DataScrubberDefaults = override.DataScrubberDefaults
+	}
+
+	if override.ScrubIPAddresses != nil {
+		merged.ScrubIPAddresses = override.ScrubIPAddresses
+	}
+
+	if override.SensitiveFields != nil {
+		merged.SensitiveFields = override.SensitiveFields
+	}
+
+	if override.SafeFields != nil {
+		merged.SafeFields = override.SafeFields
+	}
+
+	return &merged
+}
+
+func (s *PrivacySettings) empty() bool {
+	return len(s.Data()) == 0
+}
+
+// drift returns the names of the settings that differ in the given project
+func (s *PrivacySettings) drift(actual *sentryPrivacySettings) []string {
+	var fields []string
+	if s.DataScrubber != nil && *s.DataScrubber != actual.DataScrubber {
+		fields = append(fields, "data_scrubber")
+	}
+
+	if s.DataScrubberDefaults != nil && *s.DataScrubberDefaults != actual.DataScrubberDefaults {
+		fields = append(fields, "data_scrubber_defaults")
+	}
+
+	if s.ScrubIPAddresses != nil && *s.ScrubIPAddresses != actual.ScrubIPAddresses {
+		fields = append(fields, "scrub_ip_addresses")
+	}
+
+	if s.SensitiveFields != nil && !strutil.EquivalentSlices(*s.SensitiveFields, actual.SensitiveFields) {
+		fields = append(fields, "sensitive_fields")
+	}
+
+	if s.SafeFields != nil && !strutil.EquivalentSlices(*s.SafeFields, actual.SafeFields) {
+		fields = append(fields, "safe_fields")
+	}
+
+	return fields
+}
+
+// parsePrivacySettings reads the settings from the fields of a request
+// or from the raw privacy map of a project.
+func parsePrivacySettings(raw map[string]interface{}) (*PrivacySettings, error) {
+	s := new(PrivacySettings)
+	for key, value := range raw {
+		switch key {
+		case "data_scrubber", "data_scrubber_defaults", "scrub_ip_addresses":
+			v, err := parseutil.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for privacy setting %s. %s", key, err)
+			}
+
+			switch key {
+			case "data_scrubber":
+				s.DataScrubber = &v
+			case "data_scrubber_defaults":
+				s.DataScrubberDefaults = &v
+			case "scrub_ip_addresses":
+				s.ScrubIPAddresses = &v
+			}
+		case "sensitive_fields", "safe_fields":
+			v, err := parseutil.ParseCommaStringSlice(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for privacy setting %s. %s", key, err)
+			}
+
+			if key == "sensitive_fields" {
+				s.SensitiveFields = &v
+			} else {
+				s.SafeFields = &v
+			}
+		default:
+			return nil, fmt.Errorf("unknown privacy setting %s", key)
+		}
+	}
+
+	return s, nil
+}
+
+// PrivacyPolicy is the mount level privacy policy applied to every project
+type PrivacyPolicy struct {
+	PrivacySettings
+	Enforce           bool `json:"enforce"`
+	ReconcileInterval int  `json:"reconcile_interval"`
+}
+
+func (p *PrivacyPolicy) Data() map[string]interface{} {
+	data := p.PrivacySettings.Data()
+	data["enforce"] = p.Enforce
+	data["reconcile_interval"] = p.ReconcileInterval
+	return data
+}
+
+// PrivacyStatus is the result of the last privacy reconciliation
+type PrivacyStatus struct {
+	LastRun   time.Time           `json:"last_run"`
+	Checked   int                 `json:"checked"`
+	Drift     map[string][]string `json:"drift"`
+	Corrected []string            `json:"corrected"`
+	Errors    map[string]string   `json:"errors"`
+}
+
+func (s *PrivacyStatus) Data() map[string]interface{} {
+	return map[string]interface{}{
+		"last_run":  s.LastRun.Format(time.RFC3339),
+		"checked":   s.Checked,
+		"drift":     s.Drift,
+		"corrected": s.Corrected,
+		"errors":    s.Errors,
+	}
+}
+
+// sentryPrivacySettings is the representation of the settings in the sentry API
+type sentryPrivacySettings struct {
+	DataScrubber         bool     `json:"dataScrubber"`
+	DataScrubberDefaults bool     `json:"dataScrubberDefaults"`
+	ScrubIPAddresses     bool     `json:"scrubIPAddresses"`
+	SensitiveFields      []string `json:"sensitiveFields"`
+	SafeFields           []string `json:"safeFields"`
+}
+
+// applyPrivacySettings pushes the settings that are set to the project in sentry
+func applyPrivacySettings(client *sentry.Client, org, project string, s *PrivacySettings) error {
+	update := map[string]interface{}{}
+	if s.DataScrubber != nil {
+		update["dataScrubber"] = *s.DataScrubber
+	}
+
+	if s.DataScrubberDefaults != nil {
+		update["dataScrubberDefaults"] = *s.DataScrubberDefaults
+	}
+
+	if s.ScrubIPAddresses != nil {
+		update["scrubIPAddresses"] = *s.ScrubIPAddresses
+	}
+
+	if s.SensitiveFields != nil {
+		update["sensitiveFields"] = *s.SensitiveFields
+	}
+
+	if s.SafeFields != nil {
+		update["safeFields"] = *s.SafeFields
+	}
+
+	if len(update) == 0 {
+		return nil
+	}
+
+	return sentryRequest(client, http.MethodPut, fmt.Sprintf("projects/%s/%s/", org, project), update, nil)
+}
+
+func loadPrivacyPolicy(ctx context.Context, storage logical.Storage) (*PrivacyPolicy, error) {
+	entry, err := storage.Get(ctx, KeyPrivacyPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	item := new(PrivacyPolicy)
+	err = entry.DecodeJSON(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func loadPrivacyStatus(ctx context.Context, storage logical.Storage) (*PrivacyStatus, error) {
+	entry, err := storage.Get(ctx, KeyPrivacyStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	item := new(PrivacyStatus)
+	err = entry.DecodeJSON(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// effectivePrivacySettings returns the mount policy merged with the overrides of the project
+func effectivePrivacySettings(ctx context.Context, storage logical.Storage, project *SentryProject) (*PrivacySettings, error) {
+	policy, err := loadPrivacyPolicy(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := new(PrivacySettings)
+	if policy != nil {
+		settings = &policy.PrivacySettings
+	}
+
+	return settings.merge(project.Privacy), nil
+}
+
+func handlePrivacyPolicyRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	policy, err := loadPrivacyPolicy(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy == nil {
+		return logical.ErrorResponse("privacy policy is not configured"), nil
+	}
+
+	return &logical.Response{
+		Data: policy.Data(),
+	}, nil
+}
+
+func handlePrivacyPolicyUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	raw := map[string]interface{}{}
+	for _, key := range []string{"data_scrubber", "data_scrubber_defaults", "scrub_ip_addresses", "sensitive_fields", "safe_fields"} {
+		if v, ok := data.GetOk(key); ok {
+			raw[key] = v
+		}
+	}
+
+	settings, err := parsePrivacySettings(raw)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	policy := &PrivacyPolicy{
+		PrivacySettings:   *settings,
+		Enforce:           data.Get("enforce").(bool),
+		ReconcileInterval: data.Get("reconcile_interval").(int),
+	}
+
+	entry, err := logical.StorageEntryJSON(KeyPrivacyPolicy, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	err = req.Storage.Put(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: policy.Data(),
+	}, nil
+}
+
+func handlePrivacyPolicyDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	err := req.Storage.Delete(ctx, KeyPrivacyPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func handlePrivacyStatusRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	status, err := loadPrivacyStatus(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if status == nil {
+		return logical.ErrorResponse("privacy settings have not been reconciled yet"), nil
+	}
+
+	return &logical.Response{
+		Data: status.Data(),
+	}, nil
+}
+
+func (b *backend) handlePrivacyReconcile(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	status, err := b.reconcilePrivacy(ctx, req.Storage, data.Get("fix").(bool))
+	if err != nil {
+		return logical.ErrorResponse("failed to reconcile privacy settings. %s", err), nil
+	}
+
+	return &logical.Response{
+		Data: status.Data(),
+	}, nil
+}
+
+// reconcilePrivacyIfDue reconciles the privacy settings of all projects when
+// the reconcile interval of the policy has elapsed since the last run.
+func (b *backend) reconcilePrivacyIfDue(ctx context.Context, storage logical.Storage) error {
+	policy, err := loadPrivacyPolicy(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	if policy == nil || policy.ReconcileInterval <= 0 {
+		return nil
+	}
+
+	status, err := loadPrivacyStatus(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	if status != nil && time.Since(status.LastRun) < time.Duration(policy.ReconcileInterval)*time.Second {
+		return nil
+	}
+
+	_, err = b.reconcilePrivacy(ctx, storage, policy.Enforce)
+	return err
+}
+
+// reconcilePrivacy compares the privacy settings of every project with the
+// effective settings in Vault, records the drift and corrects it when fix is set.
+func (b *backend) reconcilePrivacy(ctx context.Context, storage logical.Storage, fix bool) (*PrivacyStatus, error) {
+	config, err := loadConfig(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return nil, fmt.Errorf("plugin is not configured")
+	}
+
+	client, err := b.client(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := storage.List(ctx, KeyProjectConfigPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &PrivacyStatus{
+		LastRun:   time.Now().UTC(),
+		Drift:     map[string][]string{},
+		Corrected: []string{},
+		Errors:    map[string]string{},
+	}
+
+	for _, name := range names {
+		project, err := loadProject(ctx, storage, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if project == nil {
+			continue
+		}
+
+		settings, err := effectivePrivacySettings(ctx, storage, project)
+		if err != nil {
+			return nil, err
+		}
+
+		if settings.empty() {
+			continue
+		}
+
+		status.Checked++
+
+		actual := new(sentryPrivacySettings)
+		err = b.withProject(ctx, storage, client, config, project, func(slug string) error {
+			return sentryRequest(client, http.MethodGet, fmt.Sprintf("projects/%s/%s/", config.Name, slug), nil, actual)
+		})
+		if err != nil {
+			status.Errors[name] = err.Error()
+			continue
+		}
+
+		drift := settings.drift(actual)
+		if len(drift) == 0 {
+			continue
+		}
+
+		status.Drift[name] = drift
+		b.Logger().Warn("privacy settings drifted", "project", name, "fields", drift)
+
+		if !fix {
+			continue
+		}
+
+		err = applyPrivacySettings(client, config.Name, project.slug(), settings)
+		if err != nil {
+			status.Errors[name] = err.Error()
+			continue
+		}
+
+		status.Corrected = append(status.Corrected, name)
+	}
+
+	sort.Strings(status.Corrected)
+
+	entry, err := logical.StorageEntryJSON(KeyPrivacyStatus, status)
+	if err != nil {
+		return nil, err
+	}
+
+	err = storage.Put(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	logicaltest "github.com/hashicorp/vault/helper/testhelpers/logical"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"testing"
+)
+
+func TestHandlePrivacy(t *testing.T) {
+	org, team := "privacy-org", "test-team"
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		LogicalBackend: testGetBackend(t),
+		Steps: []logicaltest.TestStep{
+			testWriteConfig(org, "token", localSentry.url, 10),
+			testWritePrivacyPolicy(),
+			testReadPrivacyPolicy(),
+			testWriteProjectPrivacy(org, "compliant", team, nil),
+			testWriteProjectPrivacy(org, "exempt", team, map[string]interface{}{"data_scrubber": false}),
+			testReconcilePrivacy(false, map[string][]string{
+				"compliant": {"data_scrubber", "scrub_ip_addresses", "sensitive_fields"},
+				"exempt":    {"scrub_ip_addresses", "sensitive_fields"},
+			}, []string{}),
+			testReconcilePrivacy(true, map[string][]string{
+				"compliant": {"data_scrubber", "scrub_ip_addresses", "sensitive_fields"},
+				"exempt":    {"scrub_ip_addresses", "sensitive_fields"},
+			}, []string{"compliant", "exempt"}),
+			testReadPrivacyStatus(2, []string{"compliant", "exempt"}),
+		},
+	})
+}
+
+func testWritePrivacyPolicy() logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "config/privacy",
+		Data: map[string]interface{}{
+			"data_scrubber":      true,
+			"scrub_ip_addresses": true,
+			"sensitive_fields":   "card_number,national_id",
+		},
+	}
+}
+
+func testReadPrivacyPolicy() logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ReadOperation,
+		Path:      "config/privacy",
+		Check: func(resp *logical.Response) error {
+			expect := map[string]interface{}{
+				"data_scrubber":      true,
+				"scrub_ip_addresses": true,
+				"sensitive_fields":   []string{"card_number", "national_id"},
+				"enforce":            false,
+				"reconcile_interval": 3600,
+			}
+
+			if !cmp.Equal(expect, resp.Data) {
+				return fmt.Errorf("unexpected data in read response. %s", cmp.Diff(expect, resp.Data))
+			}
+
+			return nil
+		},
+	}
+}
+
+func testWriteProjectPrivacy(org, name, team string, privacy map[string]interface{}) logicaltest.TestStep {
+	localSentry.handleStatic("/projects/"+org+"/"+name+"/", http.StatusOK, fmt.Sprintf(getProjectResponseBody, name))
+
+	data := map[string]interface{}{
+		"team": team,
+	}
+
+	if privacy != nil {
+		data["privacy"] = privacy
+	}
+
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "project/" + name,
+		Data:      data,
+	}
+}
+
+func testReconcilePrivacy(fix bool, drift map[string][]string, corrected []string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "privacy/reconcile",
+		Data: map[string]interface{}{
+			"fix": fix,
+		},
+		Check: func(resp *logical.Response) error {
+			if !cmp.Equal(drift, resp.Data["drift"]) {
+				return fmt.Errorf("unexpected drift. %s", cmp.Diff(drift, resp.Data["drift"]))
+			}
+
+			if !cmp.Equal(corrected, resp.Data["corrected"]) {
+				return fmt.Errorf("unexpected corrected projects. %s", cmp.Diff(corrected, resp.Data["corrected"]))
+			}
+
+			return nil
+		},
+	}
+}
+
+func testReadPrivacyStatus(checked int, corrected []string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ReadOperation,
+		Path:      "privacy/status",
+		Check: func(resp *logical.Response) error {
+			if resp.Data["checked"] != checked {
+				return fmt.Errorf("unexpected number of checked projects %v, expected %d", resp.Data["checked"], checked)
+			}
+
+			if !cmp.Equal(corrected, resp.Data["corrected"]) {
+				return fmt.Errorf("unexpected corrected projects. %s", cmp.Diff(corrected, resp.Data["corrected"]))
+			}
+
+			return nil
+		},
+	}
+}
@@ -2,30 +2,112 @@ package backend
 
 import (
 	"context"
+	"fmt"
 	"github.com/atlassian/go-sentry-api"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"net/http"
+	"regexp"
 )
 
 const KeyProjectConfigPrefix = "projects/"
 
 type SentryProject struct {
-	Name            string `json:"name"`
-	DisplayName     string `json:"display_name"`
-	Team            string `json:"team"`
-	Org             string `json:"org"`
-	DefaultDsnLabel string `json:"default_dsn_label"`
+	Name            string           `json:"name"`
+	DisplayName     string           `json:"display_name"`
+	SentryID        string           `json:"sentry_id,omitempty"`
+	Slug            string           `json:"slug,omitempty"`
+	Version         int              `json:"version"`
+	Team            string           `json:"team"`
+	Org             string           `json:"org"`
+	DefaultDsnLabel string           `json:"default_dsn_label"`
+	InboundFilters  *InboundFilters  `json:"inbound_filters,omitempty"`
+	Privacy         *PrivacySettings `json:"privacy,omitempty"`
+
+	DsnAutoCreate         *bool    `json:"dsn_auto_create,omitempty"`
+	DsnAllowedLabels      []string `json:"dsn_allowed_labels,omitempty"`
+	DsnAllowedLabelsRegex string   `json:"dsn_allowed_labels_regex,omitempty"`
+	MaxDsnLabels          *int     `json:"max_dsn_labels,omitempty"`
 }
 
 func (p *SentryProject) Data() map[string]interface{} {
-	return map[string]interface{}{
+	data := map[string]interface{}{
 		"name":              p.Name,
 		"display_name":      p.DisplayName,
+		"sentry_id":         p.SentryID,
+		"slug":              p.slug(),
 		"team":              p.Team,
 		"org":               p.Org,
 		"default_dsn_label": p.DefaultDsnLabel,
+		"version":           p.Version,
 	}
+
+	if p.InboundFilters != nil {
+		data["inbound_filters"] = p.InboundFilters.Data()
+	}
+
+	if p.Privacy != nil {
+		data["privacy"] = p.Privacy.Data()
+	}
+
+	if p.DsnAutoCreate != nil {
+		data["dsn_auto_create"] = *p.DsnAutoCreate
+	}
+
+	if len(p.DsnAllowedLabels) > 0 {
+		data["dsn_allowed_labels"] = p.DsnAllowedLabels
+	}
+
+	if p.DsnAllowedLabelsRegex != "" {
+		data["dsn_allowed_labels_regex"] = p.DsnAllowedLabelsRegex
+	}
+
+	if p.MaxDsnLabels != nil {
+		data["max_dsn_labels"] = *p.MaxDsnLabels
+	}
+
+	return data
+}
+
+// slug returns the slug of the project in sentry. Entries stored before the
+// slug was recorded only have the name, which was used as the slug.
+func (p *SentryProject) slug() string {
+	if p.Slug != "" {
+		return p.Slug
+	}
+
+	return p.DisplayName
+}
+
+// dsnAutoCreate returns true if reads may create missing DSN labels in sentry.
+// Projects that do not set a policy inherit the mount default.
+func (p *SentryProject) dsnAutoCreate(config *SentryOrg) bool {
+	if p.DsnAutoCreate != nil {
+		return *p.DsnAutoCreate
+	}
+
+	return config.DsnAutoCreate
+}
+
+// dsnLabelAllowed returns true if the label may be created for the project.
+// Every label is allowed unless a list or a regex of allowed labels is set.
+func (p *SentryProject) dsnLabelAllowed(label string) bool {
+	if len(p.DsnAllowedLabels) == 0 && p.DsnAllowedLabelsRegex == "" {
+		return true
+	}
+
+	if strutil.StrListContains(p.DsnAllowedLabels, label) {
+		return true
+	}
+
+	if p.DsnAllowedLabelsRegex == "" {
+		return false
+	}
+
+	re, err := regexp.Compile(p.DsnAllowedLabelsRegex)
+	return err == nil && re.MatchString(label)
 }
 
 func loadProject(ctx context.Context, storage logical.Storage, name string) (*SentryProject, error) {
@@ -58,9 +140,15 @@ func handleProjectRead(ctx context.Context, req *logical.Request, data *framewor
 		return logical.ErrorResponse("project %s is not configured in Vault", projectName), nil
 	}
 
-	return &logical.Response{
+	resp := &logical.Response{
 		Data: project.Data(),
-	}, nil
+	}
+
+	if projectName == selfName {
+		resp.AddWarning(projectSelfWarning)
+	}
+
+	return resp, nil
 }
 
 func handleProjectsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -72,23 +160,98 @@ func handleProjectsList(ctx context.Context, req *logical.Request, data *framewo
 	return logical.ListResponse(items), nil
 }
 
-func handleProjectUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+func (b *backend) handleProjectUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	vaultProjectName := data.Get("project").(string)
 	sentryProjectName := data.Get("sentry_project").(string)
 	teamName := data.Get("team").(string)
 	defaultDsnLabel := data.Get("default_dsn_label").(string)
 
+	// Writes of a project are serialized so that the version
+	// can not change between the check-and-set and the write
+	lock := b.projectLock(vaultProjectName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Lookup Vault storage for settings that might be set in earlier request(s)
+	vaultProject, err := loadProject(ctx, req.Storage, vaultProjectName)
+	if err != nil {
+		return nil, err
+	}
+
+	version := 0
+	if vaultProject != nil {
+		version = vaultProject.Version
+	}
+
+	if vaultProject == nil && vaultProjectName == selfName {
+		return logical.ErrorResponse("project name %s is reserved for dsn/self", selfName), nil
+	}
+
+	if v, ok := data.GetOk("cas"); ok && v.(int) != version {
+		return logical.ErrorResponse("check-and-set parameter did not match the current version %d of project %s", version, vaultProjectName), nil
+	}
+
 	if sentryProjectName == "" {
 		sentryProjectName = vaultProjectName
+		if vaultProject != nil {
+			sentryProjectName = vaultProject.slug()
+		}
+	}
+
+	item := &SentryProject{
+		Name:            vaultProjectName,
+		Team:            teamName,
+		DefaultDsnLabel: defaultDsnLabel,
+		Version:         version + 1,
+	}
+
+	var filters *InboundFilters
+	var privacy *PrivacySettings
+	if vaultProject != nil {
+		filters = vaultProject.InboundFilters
+		privacy = vaultProject.Privacy
+		item.DsnAutoCreate = vaultProject.DsnAutoCreate
+		item.DsnAllowedLabels = vaultProject.DsnAllowedLabels
+		item.DsnAllowedLabelsRegex = vaultProject.DsnAllowedLabelsRegex
+		item.MaxDsnLabels = vaultProject.MaxDsnLabels
+	}
+
+	if v, ok := data.GetOk("max_dsn_labels"); ok {
+		maxLabels := v.(int)
+		if maxLabels < 0 {
+			return logical.ErrorResponse("max_dsn_labels must not be negative"), nil
+		}
+
+		item.MaxDsnLabels = &maxLabels
+	}
+
+	if v, ok := data.GetOk("dsn_auto_create"); ok {
+		autoCreate := v.(bool)
+		item.DsnAutoCreate = &autoCreate
+	}
 
-		// Lookup Vault storage for sentry project name, might be name set in earlier request(s)
-		vaultProject, err := loadProject(ctx, req.Storage, vaultProjectName)
+	if v, ok := data.GetOk("dsn_allowed_labels"); ok {
+		item.DsnAllowedLabels = v.([]string)
+	}
+
+	if v, ok := data.GetOk("dsn_allowed_labels_regex"); ok {
+		item.DsnAllowedLabelsRegex = v.(string)
+		if _, err := regexp.Compile(item.DsnAllowedLabelsRegex); err != nil {
+			return logical.ErrorResponse("invalid dsn_allowed_labels_regex. %s", err), nil
+		}
+	}
+
+	if raw, ok := data.GetOk("inbound_filters"); ok {
+		filters, err = parseInboundFilters(raw.(map[string]interface{}))
 		if err != nil {
-			return nil, err
+			return logical.ErrorResponse(err.Error()), nil
 		}
+	}
 
-		if vaultProject != nil {
-			sentryProjectName = vaultProject.DisplayName
+	if raw, ok := data.GetOk("privacy"); ok {
+		privacy, err = parsePrivacySettings(raw.(map[string]interface{}))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
 		}
 	}
 
@@ -101,25 +264,37 @@ func handleProjectUpdate(ctx context.Context, req *logical.Request, data *framew
 		return logical.ErrorResponse("plugin is not configured"), nil
 	}
 
-	client, err := config.Client()
+	client, err := b.client(ctx, config)
 	if err != nil {
 		return nil, err
 	}
 
 	// Attempt to read project from sentry or create a new one
 	// if the project does not exist.
-	sentryProject, err := client.GetProject(sentry.Organization{
-		Slug: &config.Name,
-	}, sentryProjectName)
+	var created, committed bool
+	var sentryProject sentry.Project
+	getProject := func(slug string) (err error) {
+		sentryProject, err = client.GetProject(sentry.Organization{Slug: &config.Name}, slug)
+		return err
+	}
+
+	// A project that is already configured is looked up by its ID
+	// when it was renamed in sentry, instead of creating a new one.
+	// The entry is stored below, while the project lock is held.
+	if vaultProject != nil && sentryProjectName == vaultProject.slug() {
+		err = b.withProject(ctx, nil, client, config, vaultProject, getProject)
+	} else {
+		err = getProject(sentryProjectName)
+	}
 
 	if err != nil {
 		apiErr, ok := err.(sentry.APIError)
 		if !ok {
-			return logical.ErrorResponse("failed to read project information from sentry. %s", err), nil
+			return sentryErrorResponse(ctx, req, err, "failed to read project information from sentry")
 		}
 
 		if apiErr.StatusCode != http.StatusNotFound {
-			return logical.ErrorResponse("failed to read project information from sentry. %s", apiErr), nil
+			return sentryErrorResponse(ctx, req, apiErr, "failed to read project information from sentry")
 		}
 
 		sentryProject, err = client.CreateProject(
@@ -130,16 +305,48 @@ func handleProjectUpdate(ctx context.Context, req *logical.Request, data *framew
 		)
 
 		if err != nil {
-			return logical.ErrorResponse("failed to create new project in sentry. %s", err), nil
+			return sentryErrorResponse(ctx, req, err, "failed to create new project in sentry")
 		}
+
+		created = true
 	}
 
-	item := &SentryProject{
-		Name:            vaultProjectName,
-		DisplayName:     sentryProject.Name,
-		Org:             config.Name,
-		Team:            teamName,
-		DefaultDsnLabel: defaultDsnLabel,
+	projectSlug := sentryProjectName
+	if sentryProject.Slug != nil {
+		projectSlug = *sentryProject.Slug
+	}
+
+	// A project created by this request is removed again if configuring it fails
+	defer func() {
+		if created && !committed {
+			b.rollback(config, "project "+projectSlug, func(client *sentry.Client) error {
+				return client.DeleteProject(sentry.Organization{Slug: &config.Name}, sentry.Project{Slug: &projectSlug})
+			})
+		}
+	}()
+
+	if filters != nil {
+		err = applyInboundFilters(client, config.Name, projectSlug, filters)
+		if err != nil {
+			return sentryErrorResponse(ctx, req, err, "failed to configure inbound filters in sentry")
+		}
+	}
+
+	item.DisplayName = sentryProject.Name
+	item.SentryID = sentryProject.ID
+	item.Slug = projectSlug
+	item.Org = config.Name
+	item.InboundFilters = filters
+	item.Privacy = privacy
+
+	privacySettings, err := effectivePrivacySettings(ctx, req.Storage, item)
+	if err != nil {
+		return nil, err
+	}
+
+	err = applyPrivacySettings(client, config.Name, projectSlug, privacySettings)
+	if err != nil {
+		return sentryErrorResponse(ctx, req, err, "failed to configure privacy settings in sentry")
 	}
 
 	entry, err := logical.StorageEntryJSON(KeyProjectConfigPrefix+vaultProjectName, item)
@@ -152,6 +359,8 @@ func handleProjectUpdate(ctx context.Context, req *logical.Request, data *framew
 		return nil, err
 	}
 
+	committed = true
+
 	return &logical.Response{
 		Data: item.Data(),
 	}, nil
@@ -181,6 +390,19 @@ func handleProjectDelete(ctx context.Context, req *logical.Request, data *framew
 		}
 	}
 
+	// Monitors are kept in sentry, only forget them in vault
+	keys, err = req.Storage.List(ctx, KeyMonitorPrefix+projectName+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		err = req.Storage.Delete(ctx, KeyMonitorPrefix+projectName+"/"+key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Remove project name from vault
 	err = req.Storage.Delete(ctx, KeyProjectConfigPrefix+projectName)
 	if err != nil {
@@ -194,3 +416,141 @@ func handleProjectDelete(ctx context.Context, req *logical.Request, data *framew
 		},
 	}, nil
 }
+
+// projectLock returns the lock that serializes writes of a project configuration
+func (b *backend) projectLock(name string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.projectLocks, name)
+}
+
+// withProject calls fn with the slug of the project in sentry. When sentry
+// does not know the slug, the project may have been renamed, so it is looked
+// up by its ID and fn is called again with the new slug. Entries stored
+// before the ID was recorded are resolved first to record it. The refreshed
+// project is stored unless storage is nil, which callers that store the
+// project themselves pass while holding the project lock.
+func (b *backend) withProject(ctx context.Context, storage logical.Storage, client *sentry.Client, config *SentryOrg, project *SentryProject, fn func(slug string) error) error {
+	if project.SentryID == "" {
+		if _, err := b.refreshProject(ctx, storage, client, config, project); err != nil {
+			b.Logger().Warn("failed to record the sentry ID of project", "project", project.Name, "error", err)
+		}
+	}
+
+	err := fn(project.slug())
+	if !isNotFound(err) {
+		return err
+	}
+
+	changed, rerr := b.refreshProject(ctx, storage, client, config, project)
+	if rerr != nil {
+		b.Logger().Warn("failed to look up renamed project", "project", project.Name, "error", rerr)
+		return err
+	}
+
+	if !changed {
+		return err
+	}
+
+	return fn(project.slug())
+}
+
+// refreshProject updates the ID, slug and name of the project from sentry
+// and stores them when they changed. The project is found by its ID. Entries
+// without an ID are matched by their slug only to record the ID, a renamed
+// project can only be followed once its ID is known.
+func (b *backend) refreshProject(ctx context.Context, storage logical.Storage, client *sentry.Client, config *SentryOrg, project *SentryProject) (bool, error) {
+	projects, err := listOrgProjects(client, config.Name)
+	if err != nil {
+		return false, err
+	}
+
+	var found *sentry.Project
+	for i, p := range projects {
+		if project.SentryID != "" && p.ID == project.SentryID {
+			found = &projects[i]
+			break
+		}
+
+		if project.SentryID == "" && p.Slug != nil && *p.Slug == project.slug() {
+			found = &projects[i]
+			break
+		}
+	}
+
+	if found == nil || found.Slug == nil {
+		if project.SentryID != "" {
+			return false, fmt.Errorf("project with ID %s was not found in sentry", project.SentryID)
+		}
+
+		return false, fmt.Errorf("project %s was not found in sentry", project.slug())
+	}
+
+	if found.ID == project.SentryID && *found.Slug == project.Slug && found.Name == project.DisplayName {
+		return false, nil
+	}
+
+	if project.Slug != "" && *found.Slug != project.Slug {
+		b.Logger().Info("project was renamed in sentry", "project", project.Name, "from", project.Slug, "to", *found.Slug)
+	}
+
+	project.SentryID = found.ID
+	project.Slug = *found.Slug
+	project.DisplayName = found.Name
+
+	if storage == nil {
+		return true, nil
+	}
+
+	// The entry is reloaded under the project lock so that
+	// a concurrent write of the project is not overwritten
+	lock := b.projectLock(project.Name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	stored, err := loadProject(ctx, storage, project.Name)
+	if err != nil {
+		return false, err
+	}
+
+	if stored == nil {
+		return true, nil
+	}
+
+	stored.SentryID = project.SentryID
+	stored.Slug = project.Slug
+	stored.DisplayName = project.DisplayName
+	stored.Version++
+
+	entry, err := logical.StorageEntryJSON(KeyProjectConfigPrefix+project.Name, stored)
+	if err != nil {
+		return false, err
+	}
+
+	err = storage.Put(ctx, entry)
+	if err != nil {
+		return false, err
+	}
+
+	project.Version = stored.Version
+
+	return true, nil
+}
+
+// listOrgProjects returns every project of the organization
+func listOrgProjects(client *sentry.Client, org string) ([]sentry.Project, error) {
+	projects, link, err := client.GetOrgProjects(sentry.Organization{Slug: &org})
+	if err != nil {
+		return nil, err
+	}
+
+	for link != nil && link.Next.Results {
+		var page []sentry.Project
+		link, err = client.GetPage(link.Next, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		projects = append(projects, page...)
+	}
+
+	return projects, nil
+}
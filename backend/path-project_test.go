@@ -1,12 +1,14 @@
 package backend
 
 import (
+	"context"
 	"fmt"
 	"github.com/google/go-cmp/cmp"
 	logicaltest "github.com/hashicorp/vault/helper/testhelpers/logical"
 	"github.com/hashicorp/vault/sdk/logical"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -30,6 +32,276 @@ func TestHandleProject(t *testing.T) {
 	})
 }
 
+func TestHandleProjectInboundFilters(t *testing.T) {
+	org, name, team := "filters-org", "filtered-project", "test-team"
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		LogicalBackend: testGetBackend(t),
+		Steps: []logicaltest.TestStep{
+			testWriteConfig(org, "token", localSentry.url, 10),
+			testWriteProjectFiltersErr(name, team, map[string]interface{}{"unknown": true}, "invalid value for inbound filter unknown"),
+			testWriteProjectFilters(org, name, team, map[string]interface{}{
+				"browser_extensions": true,
+				"localhost":          "true",
+				"legacy_browsers":    []interface{}{"ie_pre_9", "safari_pre_6"},
+				"error_messages":     "TypeError*,ResizeObserver*",
+			}),
+			testReadProjectFilters(name, map[string]interface{}{
+				"browser_extensions": true,
+				"web_crawlers":       false,
+				"localhost":          true,
+				"legacy_browsers":    []string{"ie_pre_9", "safari_pre_6"},
+				"error_messages":     []string{"TypeError*", "ResizeObserver*"},
+				"releases":           []string{},
+			}),
+		},
+	})
+}
+
+func TestHandleProjectRollback(t *testing.T) {
+	org, name, team := "rollback-org", "half-project", "test-team"
+
+	var deleted int32
+	localSentry.mux.HandleFunc("/projects/"+org+"/"+name+"/", func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodDelete {
+			atomic.AddInt32(&deleted, 1)
+			resp.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		resp.WriteHeader(http.StatusNotFound)
+	})
+
+	localSentry.handleStatic("/teams/"+org+"/"+team+"/projects/", http.StatusCreated, fmt.Sprintf(getProjectResponseBody, name))
+	localSentry.handleStatic("/projects/"+org+"/"+name+"/filters/", http.StatusBadRequest, `{"detail": "invalid filter"}`)
+
+	logicaltest.Test(t, logicaltest.TestCase{
+		LogicalBackend: testGetBackend(t),
+		Steps: []logicaltest.TestStep{
+			testWriteConfig(org, "token", localSentry.url, 10),
+			{
+				Operation: logical.UpdateOperation,
+				Path:      "project/" + name,
+				Data: map[string]interface{}{
+					"team":            team,
+					"inbound_filters": map[string]interface{}{"localhost": true},
+				},
+				Check: func(resp *logical.Response) error {
+					return testSentryError(resp, http.StatusBadRequest, "failed to configure inbound filters in sentry")
+				},
+			},
+			testReadProjectErr(name, "project half-project is not configured in Vault"),
+		},
+	})
+
+	if deleted != 1 {
+		t.Errorf("expected the partially created project to be deleted, got %d deletions", deleted)
+	}
+}
+
+func testWriteProjectFilters(org, name, team string, filters map[string]interface{}) logicaltest.TestStep {
+	localSentry.handleStatic("/projects/"+org+"/"+name+"/", http.StatusOK, fmt.Sprintf(getProjectResponseBody, name))
+	for _, filter := range []string{"browser-extensions", "web-crawlers", "localhost", "legacy-browsers"} {
+		localSentry.handleMethods("/projects/"+org+"/"+name+"/filters/"+filter+"/", map[string]testResponse{
+			http.MethodPut: {http.StatusNoContent, ""},
+		})
+	}
+
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "project/" + name,
+		Data: map[string]interface{}{
+			"team":            team,
+			"inbound_filters": filters,
+		},
+	}
+}
+
+func TestHandleProjectRenamed(t *testing.T) {
+	org := "rename-org"
+
+	localSentry.handleStatic("/organizations/"+org+"/projects/", http.StatusOK, `[
+		{"id": "5", "name": "Other App", "slug": "old-slug"},
+		{"id": "7", "name": "New Name", "slug": "new-slug"},
+		{"id": "9", "name": "Legacy App", "slug": "legacy-app"}
+	]`)
+	localSentry.handleStatic("/projects/"+org+"/old-slug/", http.StatusNotFound, `{"detail": "The requested resource does not exist"}`)
+	localSentry.handleStatic("/projects/"+org+"/new-slug/keys/", http.StatusOK, getClientKeysResponseBody)
+	localSentry.handleStatic("/projects/"+org+"/legacy-app/keys/", http.StatusOK, getClientKeysResponseBody)
+
+	ctx := context.Background()
+	b, storage := testGetBackendWithStorage(t)
+
+	testSeedStorage(t, storage, map[string]interface{}{
+		KeyConfig: &SentryOrg{Name: org, Endpoint: localSentry.url, ConnectionTimeout: 10},
+		KeyProjectConfigPrefix + "renamed-app": &SentryProject{
+			Name:        "renamed-app",
+			DisplayName: "Old Name",
+			SentryID:    "7",
+			Slug:        "old-slug",
+			Version:     1,
+		},
+		// Entries stored before the ID and slug were recorded
+		// used the name of the sentry project as its slug
+		KeyProjectConfigPrefix + "legacy-app": &SentryProject{
+			Name:        "legacy-app",
+			DisplayName: "legacy-app",
+			Version:     1,
+		},
+		// Projects are not matched by name, even though
+		// "Other App" has the slug that sentry does not know
+		KeyProjectConfigPrefix + "deleted-app": &SentryProject{
+			Name:        "deleted-app",
+			DisplayName: "Other App",
+			SentryID:    "11",
+			Slug:        "old-slug",
+			Version:     1,
+		},
+	})
+
+	expect := map[string]SentryProject{
+		"renamed-app": {Name: "renamed-app", DisplayName: "New Name", SentryID: "7", Slug: "new-slug", Version: 2},
+		"legacy-app":  {Name: "legacy-app", DisplayName: "Legacy App", SentryID: "9", Slug: "legacy-app", Version: 2},
+	}
+
+	for name, want := range expect {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "dsn/" + name + "/primary",
+			Storage:   storage,
+		})
+
+		if err != nil || resp.IsError() || resp.Data["dsn"] != "https://test@sentry.io/2" {
+			t.Errorf("failed to read DSN of project %s. %v %v", name, resp, err)
+			continue
+		}
+
+		project, err := loadProject(ctx, storage, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !cmp.Equal(want, *project) {
+			t.Errorf("unexpected project %s after reading its DSN. %s", name, cmp.Diff(want, *project))
+		}
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "dsn/deleted-app/primary",
+		Storage:   storage,
+	})
+
+	if err != nil || resp.Data[logical.HTTPStatusCode] != http.StatusNotFound {
+		t.Errorf("expected DSN read of a project whose ID is not known to sentry to fail, got %v %v", resp, err)
+	}
+
+	project, err := loadProject(ctx, storage, "deleted-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if project.SentryID != "11" || project.Version != 1 {
+		t.Errorf("expected project with an unknown ID to be left unchanged, got %+v", project)
+	}
+}
+
+func TestHandleProjectCheckAndSet(t *testing.T) {
+	org, name := "cas-org", "cas-app"
+	localSentry.handleStatic("/projects/"+org+"/"+name+"/", http.StatusOK, fmt.Sprintf(getProjectResponseBody, name))
+
+	ctx := context.Background()
+	b, storage := testGetBackendWithStorage(t)
+
+	testSeedStorage(t, storage, map[string]interface{}{
+		KeyConfig: &SentryOrg{Name: org, Endpoint: localSentry.url, ConnectionTimeout: 10},
+	})
+
+	write := func(data map[string]interface{}) (*logical.Response, error) {
+		data["team"] = "test-team"
+
+		return b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "project/" + name,
+			Storage:   storage,
+			Data:      data,
+		})
+	}
+
+	steps := []struct {
+		data    map[string]interface{}
+		version int
+	}{
+		{map[string]interface{}{"cas": 1}, 0},
+		{map[string]interface{}{"cas": 0}, 1},
+		{map[string]interface{}{"cas": 0}, 0},
+		{map[string]interface{}{"cas": 1, "default_dsn_label": "primary"}, 2},
+		{map[string]interface{}{"cas": 1, "default_dsn_label": "stale"}, 0},
+		{map[string]interface{}{}, 3},
+	}
+
+	for i, step := range steps {
+		resp, err := write(step.data)
+		if err != nil {
+			t.Fatalf("step %d failed. %s", i, err)
+		}
+
+		if step.version == 0 {
+			if !resp.IsError() || !strings.Contains(resp.Error().Error(), "check-and-set parameter did not match") {
+				t.Errorf("expected stale write in step %d to be rejected, got %v", i, resp)
+			}
+
+			continue
+		}
+
+		if resp.IsError() || resp.Data["version"] != step.version {
+			t.Errorf("expected version %d after step %d, got %v", step.version, i, resp)
+		}
+	}
+
+	project, err := loadProject(ctx, storage, name)
+	if err != nil || project.DefaultDsnLabel != "" || project.Version != 3 {
+		t.Errorf("unexpected project after check-and-set writes. %v %v", project, err)
+	}
+}
+
+func testWriteProjectFiltersErr(name, team string, filters map[string]interface{}, msg string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.UpdateOperation,
+		Path:      "project/" + name,
+		ErrorOk:   true,
+		Data: map[string]interface{}{
+			"team":            team,
+			"inbound_filters": filters,
+		},
+		Check: func(resp *logical.Response) error {
+			if !resp.IsError() {
+				return fmt.Errorf("expected error in write response. got none")
+			}
+
+			if !strings.Contains(resp.Error().Error(), msg) {
+				return fmt.Errorf("unexpected error %q does not match %q", resp.Error(), msg)
+			}
+
+			return nil
+		},
+	}
+}
+
+func testReadProjectFilters(name string, expect map[string]interface{}) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ReadOperation,
+		Path:      "project/" + name,
+		Check: func(resp *logical.Response) error {
+			if !cmp.Equal(expect, resp.Data["inbound_filters"]) {
+				return fmt.Errorf("unexpected inbound filters in read response. %s", cmp.Diff(expect, resp.Data["inbound_filters"]))
+			}
+
+			return nil
+		},
+	}
+}
+
 func testListProjects(names ...string) logicaltest.TestStep {
 	return logicaltest.TestStep{
 		Operation: logical.ListOperation,
@@ -58,9 +330,12 @@ func testWriteProjectExisting(org, name, team, dsnLabel string) logicaltest.Test
 			expect := map[string]interface{}{
 				"name":              name,
 				"display_name":      "display-name-" + name,
+				"sentry_id":         "2",
+				"slug":              "display-name-" + name,
 				"team":              team,
 				"org":               org,
 				"default_dsn_label": dsnLabel,
+				"version":           1,
 			}
 
 			if !cmp.Equal(expect, resp.Data) {
@@ -88,9 +363,12 @@ func testWriteProjectFresh(org, name, team, dsnName string) logicaltest.TestStep
 			expect := map[string]interface{}{
 				"name":              name,
 				"display_name":      "display-name-" + name,
+				"sentry_id":         "2",
+				"slug":              "display-name-" + name,
 				"team":              team,
 				"org":               org,
 				"default_dsn_label": dsnName,
+				"version":           1,
 			}
 
 			if !cmp.Equal(expect, resp.Data) {
@@ -118,9 +396,12 @@ func testWriteProjectWithSentryName(org, name, sentryName, team, dsnName string)
 			expect := map[string]interface{}{
 				"name":              name,
 				"display_name":      sentryName,
+				"sentry_id":         "2",
+				"slug":              sentryName,
 				"team":              team,
 				"org":               org,
 				"default_dsn_label": dsnName,
+				"version":           1,
 			}
 
 			if !cmp.Equal(expect, resp.Data) {
@@ -162,9 +443,12 @@ func testReadProject(name, displayName, org, team, dsnLabel string) logicaltest.
 			expect := map[string]interface{}{
 				"name":              name,
 				"display_name":      displayName,
+				"sentry_id":         "2",
+				"slug":              displayName,
 				"team":              team,
 				"org":               org,
 				"default_dsn_label": dsnLabel,
+				"version":           1,
 			}
 
 			if !cmp.Equal(expect, resp.Data) {
@@ -216,6 +500,8 @@ func testDeleteProject(name string) logicaltest.TestStep {
 
 const getProjectResponseBody = `
 {
-  "name": "%s"
+  "id": "2",
+  "name": "%[1]s",
+  "slug": "%[1]s"
 }
 `
@@ -0,0 +1,349 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"regexp"
+	"strings"
+)
+
+const KeySelfConfig = "config/self"
+
+// selfName is reserved for dsn/self and creds/self, which are matched
+// before the paths of a project or an integration with that name.
+const selfName = "self"
+
+const (
+	projectSelfWarning     = "project self is shadowed by dsn/self, its DSN can only be read with an explicit label as dsn/self/<label>. Configure it under another name"
+	integrationSelfWarning = "integration self is shadowed by creds/self, its token can not be read. Configure it under another name"
+)
+
+// SelfConfig holds the identity templates that resolve the project, DSN
+// label and integration of the caller for dsn/self and creds/self.
+type SelfConfig struct {
+	ProjectTemplate     string `json:"project_template"`
+	LabelTemplate       string `json:"label_template"`
+	IntegrationTemplate string `json:"integration_template"`
+}
+
+func (c *SelfConfig) Data() map[string]interface{} {
+	return map[string]interface{}{
+		"project_template":     c.ProjectTemplate,
+		"label_template":       c.LabelTemplate,
+		"integration_template": c.IntegrationTemplate,
+	}
+}
+
+// defaultSelfConfig is used when the self-service paths have not been configured
+var defaultSelfConfig = SelfConfig{
+	ProjectTemplate:     "{{identity.entity.metadata.sentry_project}}",
+	LabelTemplate:       "",
+	IntegrationTemplate: "{{identity.entity.metadata.sentry_integration}}",
+}
+
+func loadSelfConfig(ctx context.Context, storage logical.Storage) (*SelfConfig, error) {
+	entry, err := storage.Get(ctx, KeySelfConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	item := defaultSelfConfig
+	if entry == nil {
+		return &item, nil
+	}
+
+	err = entry.DecodeJSON(&item)
+	if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+// selfWarnings reports a project and an integration named self that were
+// configured before the name was reserved.
+func selfWarnings(ctx context.Context, storage logical.Storage) ([]string, error) {
+	var warnings []string
+
+	project, err := loadProject(ctx, storage, selfName)
+	if err != nil {
+		return nil, err
+	}
+
+	if project != nil {
+		warnings = append(warnings, projectSelfWarning)
+	}
+
+	integration, err := loadIntegration(ctx, storage, selfName)
+	if err != nil {
+		return nil, err
+	}
+
+	if integration != nil {
+		warnings = append(warnings, integrationSelfWarning)
+	}
+
+	return warnings, nil
+}
+
+func handleSelfConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := loadSelfConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings, err := selfWarnings(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data:     config.Data(),
+		Warnings: warnings,
+	}, nil
+}
+
+func handleSelfConfigUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := loadSelfConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := data.GetOk("project_template"); ok {
+		config.ProjectTemplate = v.(string)
+	}
+
+	if v, ok := data.GetOk("label_template"); ok {
+		config.LabelTemplate = v.(string)
+	}
+
+	if v, ok := data.GetOk("integration_template"); ok {
+		config.IntegrationTemplate = v.(string)
+	}
+
+	if config.ProjectTemplate == "" {
+		return logical.ErrorResponse("project_template must not be empty"), nil
+	}
+
+	for key, tpl := range map[string]string{
+		"project_template":     config.ProjectTemplate,
+		"label_template":       config.LabelTemplate,
+		"integration_template": config.IntegrationTemplate,
+	} {
+		if _, err := identityTemplateParams(tpl); err != nil {
+			return logical.ErrorResponse("invalid %s. %s", key, err), nil
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(KeySelfConfig, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = req.Storage.Put(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings, err := selfWarnings(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data:     config.Data(),
+		Warnings: warnings,
+	}, nil
+}
+
+// handleDsnSelfRead serves the DSN of the project and label that the
+// identity templates resolve to for the entity of the caller.
+func (b *backend) handleDsnSelfRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := loadSelfConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	entity, resp, err := b.callerEntity(req)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	project, err := renderIdentityTemplate(config.ProjectTemplate, entity)
+	if err != nil {
+		return logical.ErrorResponse("failed to resolve the project of the caller. %s", err), nil
+	}
+
+	label, err := renderIdentityTemplate(config.LabelTemplate, entity)
+	if err != nil {
+		return logical.ErrorResponse("failed to resolve the DSN label of the caller. %s", err), nil
+	}
+
+	return b.handleDsnRead(ctx, req, &framework.FieldData{
+		Raw: map[string]interface{}{
+			"project": project,
+			"name":    label,
+		},
+		Schema: map[string]*framework.FieldSchema{
+			"project": {Type: framework.TypeString},
+			"name":    {Type: framework.TypeString},
+		},
+	})
+}
+
+// handleCredsSelfRead serves the token of the integration that the
+// identity template resolves to for the entity of the caller.
+func (b *backend) handleCredsSelfRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := loadSelfConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.IntegrationTemplate == "" {
+		return logical.ErrorResponse("integration_template is not configured"), nil
+	}
+
+	entity, resp, err := b.callerEntity(req)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	name, err := renderIdentityTemplate(config.IntegrationTemplate, entity)
+	if err != nil {
+		return logical.ErrorResponse("failed to resolve the integration of the caller. %s", err), nil
+	}
+
+	return handleCredsRead(ctx, req, &framework.FieldData{
+		Raw: map[string]interface{}{
+			"name": name,
+		},
+		Schema: map[string]*framework.FieldSchema{
+			"name": {Type: framework.TypeString},
+		},
+	})
+}
+
+// callerEntity returns the identity entity of the token of the request,
+// or an error response when the token has no usable entity.
+func (b *backend) callerEntity(req *logical.Request) (*logical.Entity, *logical.Response, error) {
+	if req.EntityID == "" {
+		return nil, logical.ErrorResponse("token is not associated with an identity entity"), nil
+	}
+
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if entity == nil || entity.Disabled {
+		return nil, logical.ErrorResponse("identity entity of the token does not exist or is disabled"), nil
+	}
+
+	return entity, nil, nil
+}
+
+var identityTemplateRe = regexp.MustCompile(`{{\s*([^{}]*?)\s*}}`)
+
+// identityTemplateParams returns the parameters of the template and checks
+// that they are supported. The supported parameters are a subset of Vault
+// identity templating:
+//
+//	identity.entity.id
+//	identity.entity.name
+//	identity.entity.metadata.<key>
+//	identity.entity.aliases.<mount accessor>.name
+//	identity.entity.aliases.<mount accessor>.metadata.<key>
+func identityTemplateParams(tpl string) ([]string, error) {
+	var params []string
+	for _, match := range identityTemplateRe.FindAllStringSubmatch(tpl, -1) {
+		param := match[1]
+		parts := strings.Split(param, ".")
+
+		valid := len(parts) >= 3 && parts[0] == "identity" && parts[1] == "entity"
+		if valid {
+			switch parts[2] {
+			case "id", "name":
+				valid = len(parts) == 3
+			case "metadata":
+				valid = len(parts) == 4
+			case "aliases":
+				valid = (len(parts) == 5 && parts[4] == "name") || (len(parts) == 6 && parts[4] == "metadata")
+			default:
+				valid = false
+			}
+		}
+
+		if !valid {
+			return nil, fmt.Errorf("unsupported template parameter %q", param)
+		}
+
+		params = append(params, param)
+	}
+
+	rest := identityTemplateRe.ReplaceAllString(tpl, "")
+	if strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+		return nil, fmt.Errorf("unbalanced braces in template %q", tpl)
+	}
+
+	return params, nil
+}
+
+// renderIdentityTemplate replaces the parameters of the template with the
+// values of the entity. The result must be usable as a single path segment.
+func renderIdentityTemplate(tpl string, entity *logical.Entity) (string, error) {
+	if _, err := identityTemplateParams(tpl); err != nil {
+		return "", err
+	}
+
+	var missing error
+	result := identityTemplateRe.ReplaceAllStringFunc(tpl, func(match string) string {
+		param := identityTemplateRe.FindStringSubmatch(match)[1]
+
+		value, ok := identityValue(strings.Split(param, "."), entity)
+		if !ok && missing == nil {
+			missing = fmt.Errorf("identity does not have a value for %s", param)
+		}
+
+		return value
+	})
+
+	if missing != nil {
+		return "", missing
+	}
+
+	if strings.Contains(result, "/") {
+		return "", fmt.Errorf("resolved value %q must not contain /", result)
+	}
+
+	return result, nil
+}
+
+// identityValue returns the value of a parameter that was validated by identityTemplateParams
+func identityValue(parts []string, entity *logical.Entity) (string, bool) {
+	switch parts[2] {
+	case "id":
+		return entity.ID, entity.ID != ""
+	case "name":
+		return entity.Name, entity.Name != ""
+	case "metadata":
+		value, ok := entity.Metadata[parts[3]]
+		return value, ok && value != ""
+	}
+
+	for _, alias := range entity.Aliases {
+		if alias.MountAccessor != parts[3] {
+			continue
+		}
+
+		if parts[4] == "name" {
+			return alias.Name, alias.Name != ""
+		}
+
+		value, ok := alias.Metadata[parts[5]]
+		return value, ok && value != ""
+	}
+
+	return "", false
+}
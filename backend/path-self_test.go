@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"context"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleSelfRead(t *testing.T) {
+	ctx := context.Background()
+	project := "self-app"
+
+	entity := &logical.Entity{
+		ID:       "entity-1",
+		Name:     "workload",
+		Metadata: map[string]string{"sentry_project": project, "sentry_integration": "deployer"},
+		Aliases: []*logical.Alias{
+			{MountAccessor: "auth_kubernetes_1", Name: "sa-uid", Metadata: map[string]string{"service_account_name": "worker"}},
+		},
+	}
+
+	storage := &logical.InmemStorage{}
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+	config.System = &logical.StaticSystemView{EntityVal: entity}
+
+	b, err := Factory(ctx, config)
+	if err != nil {
+		t.Fatalf("failed to initialize backend factory. %s", err)
+	}
+
+	testSeedStorage(t, storage, map[string]interface{}{
+		KeyConfig:                              &SentryOrg{Name: "self-org", Endpoint: localSentry.url, ConnectionTimeout: 10},
+		KeyProjectConfigPrefix + project:       &SentryProject{Name: project, DisplayName: project, SentryID: "2", Slug: project, DefaultDsnLabel: "default"},
+		KeyDsnPrefix + project + "/default":    &SentryDsn{Name: "default", DSN: "https://default@sentry.io/2", FetchedAt: time.Now()},
+		KeyDsnPrefix + project + "/worker":     &SentryDsn{Name: "worker", DSN: "https://worker@sentry.io/2", FetchedAt: time.Now()},
+		KeyIntegrationPrefix + "deployer":      &SentryIntegration{Name: "deployer", Slug: "deployer"},
+		KeyIntegrationTokenPrefix + "deployer": &SentryIntegrationToken{ID: "1", Token: "integration-token"},
+	})
+
+	request := func(op logical.Operation, path, entityID string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			EntityID:  entityID,
+			Data:      data,
+		})
+
+		if err != nil {
+			t.Fatalf("unexpected error on %s. %s", path, err)
+		}
+
+		return resp
+	}
+
+	expectError := func(resp *logical.Response, msg string) {
+		t.Helper()
+		if !resp.IsError() || !strings.Contains(resp.Error().Error(), msg) {
+			t.Errorf("expected error containing %q, got %v", msg, resp)
+		}
+	}
+
+	if resp := request(logical.ReadOperation, "dsn/self", "entity-1", nil); resp.Data["dsn"] != "https://default@sentry.io/2" {
+		t.Errorf("expected default DSN of the project of the entity, got %v", resp)
+	}
+
+	if resp := request(logical.ReadOperation, "creds/self", "entity-1", nil); resp.Data["token"] != "integration-token" {
+		t.Errorf("expected token of the integration of the entity, got %v", resp)
+	}
+
+	expectError(request(logical.ReadOperation, "dsn/self", "", nil), "not associated with an identity entity")
+
+	resp := request(logical.UpdateOperation, "config/self", "", map[string]interface{}{
+		"label_template": "{{identity.entity.aliases.auth_kubernetes_1.metadata.service_account_name}}",
+	})
+	if resp.IsError() || resp.Data["project_template"] != defaultSelfConfig.ProjectTemplate {
+		t.Fatalf("unexpected response to config update. %v", resp)
+	}
+
+	if resp := request(logical.ReadOperation, "dsn/self", "entity-1", nil); resp.Data["dsn"] != "https://worker@sentry.io/2" {
+		t.Errorf("expected DSN labelled after the alias metadata, got %v", resp)
+	}
+
+	expectError(request(logical.UpdateOperation, "config/self", "", map[string]interface{}{
+		"project_template": "{{identity.groups.names}}",
+	}), "unsupported template parameter")
+
+	request(logical.UpdateOperation, "config/self", "", map[string]interface{}{
+		"project_template": "{{identity.entity.metadata.missing}}",
+	})
+
+	expectError(request(logical.ReadOperation, "dsn/self", "entity-1", nil), "does not have a value for identity.entity.metadata.missing")
+
+	expectError(request(logical.UpdateOperation, "project/self", "", map[string]interface{}{"team": "test-team"}), "project name self is reserved")
+	expectError(request(logical.UpdateOperation, "integration/self", "", map[string]interface{}{"scopes": "project:read"}), "integration name self is reserved")
+
+	// Entries named self that were configured before the name was reserved are reported
+	testSeedStorage(t, storage, map[string]interface{}{
+		KeyProjectConfigPrefix + selfName: &SentryProject{Name: selfName},
+	})
+
+	if resp := request(logical.ReadOperation, "config/self", "", nil); len(resp.Warnings) != 1 || resp.Warnings[0] != projectSelfWarning {
+		t.Errorf("expected a warning about the project named self, got %v", resp.Warnings)
+	}
+}
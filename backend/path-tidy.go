@@ -0,0 +1,516 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/atlassian/go-sentry-api"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	KeyTidyConfig       = "config/tidy"
+	KeyTidyStatus       = "tidy/status"
+	KeyCreatedKeyPrefix = "created-keys/"
+)
+
+// TidyConfig controls the scheduled tidy operation
+type TidyConfig struct {
+	Interval         int  `json:"interval"`
+	DeleteUnusedKeys bool `json:"delete_unused_keys"`
+	UnusedKeyPeriod  int  `json:"unused_key_period"`
+}
+
+func (c *TidyConfig) Data() map[string]interface{} {
+	return map[string]interface{}{
+		"interval":           c.Interval,
+		"delete_unused_keys": c.DeleteUnusedKeys,
+		"unused_key_period":  c.UnusedKeyPeriod,
+	}
+}
+
+// defaultTidyConfig is used when tidy has not been configured
+var defaultTidyConfig = TidyConfig{
+	Interval:         86400,
+	DeleteUnusedKeys: false,
+	UnusedKeyPeriod:  30 * 86400,
+}
+
+// TidyStatus is the result of the last tidy operation
+type TidyStatus struct {
+	LastRun        time.Time           `json:"last_run"`
+	RemovedEntries []string            `json:"removed_entries"`
+	UntrackedKeys  map[string][]string `json:"untracked_keys"`
+	DeletedKeys    []string            `json:"deleted_keys"`
+	Errors         map[string]string   `json:"errors"`
+}
+
+func (s *TidyStatus) Data() map[string]interface{} {
+	return map[string]interface{}{
+		"last_run":        s.LastRun.Format(time.RFC3339),
+		"removed_entries": s.RemovedEntries,
+		"untracked_keys":  s.UntrackedKeys,
+		"deleted_keys":    s.DeletedKeys,
+		"errors":          s.Errors,
+	}
+}
+
+// CreatedKey records a sentry key that was created by the plugin. The record
+// outlives the DSN entry so that keys of dropped labels can be cleaned up.
+type CreatedKey struct {
+	Project     string    `json:"project"`
+	Label       string    `json:"label"`
+	KeyID       string    `json:"key_id"`
+	DateCreated time.Time `json:"date_created"`
+}
+
+func storeCreatedKey(ctx context.Context, storage logical.Storage, item *CreatedKey) error {
+	entry, err := logical.StorageEntryJSON(KeyCreatedKeyPrefix+item.Project+"/"+item.KeyID, item)
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(ctx, entry)
+}
+
+func loadCreatedKey(ctx context.Context, storage logical.Storage, project, keyID string) (*CreatedKey, error) {
+	entry, err := storage.Get(ctx, KeyCreatedKeyPrefix+project+"/"+keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	item := new(CreatedKey)
+	err = entry.DecodeJSON(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func loadTidyConfig(ctx context.Context, storage logical.Storage) (*TidyConfig, error) {
+	entry, err := storage.Get(ctx, KeyTidyConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	item := new(TidyConfig)
+	err = entry.DecodeJSON(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func loadTidyStatus(ctx context.Context, storage logical.Storage) (*TidyStatus, error) {
+	entry, err := storage.Get(ctx, KeyTidyStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	item := new(TidyStatus)
+	err = entry.DecodeJSON(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func handleTidyConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := loadTidyConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = &defaultTidyConfig
+	}
+
+	return &logical.Response{
+		Data: config.Data(),
+	}, nil
+}
+
+func handleTidyConfigUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config := &TidyConfig{
+		Interval:         data.Get("interval").(int),
+		DeleteUnusedKeys: data.Get("delete_unused_keys").(bool),
+		UnusedKeyPeriod:  data.Get("unused_key_period").(int),
+	}
+
+	if config.UnusedKeyPeriod <= 0 {
+		return logical.ErrorResponse("unused_key_period must be greater than 0"), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(KeyTidyConfig, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = req.Storage.Put(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: config.Data(),
+	}, nil
+}
+
+func handleTidyStatusRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	status, err := loadTidyStatus(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if status == nil {
+		return logical.ErrorResponse("tidy has not been run yet"), nil
+	}
+
+	return &logical.Response{
+		Data: status.Data(),
+	}, nil
+}
+
+func (b *backend) handleTidy(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := loadTidyConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := defaultTidyConfig
+	if config != nil {
+		opts = *config
+	}
+
+	if v, ok := data.GetOk("delete_unused_keys"); ok {
+		opts.DeleteUnusedKeys = v.(bool)
+	}
+
+	if v, ok := data.GetOk("unused_key_period"); ok {
+		opts.UnusedKeyPeriod = v.(int)
+	}
+
+	if opts.UnusedKeyPeriod <= 0 {
+		return logical.ErrorResponse("unused_key_period must be greater than 0"), nil
+	}
+
+	status, err := b.tidy(ctx, req.Storage, opts)
+	if err != nil {
+		return logical.ErrorResponse("failed to tidy. %s", err), nil
+	}
+
+	return &logical.Response{
+		Data: status.Data(),
+	}, nil
+}
+
+// tidyIfDue runs tidy when the configured interval has elapsed since the last run
+func (b *backend) tidyIfDue(ctx context.Context, storage logical.Storage) error {
+	config, err := loadTidyConfig(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	if config == nil {
+		config = &defaultTidyConfig
+	}
+
+	if config.Interval <= 0 {
+		return nil
+	}
+
+	status, err := loadTidyStatus(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	if status != nil && time.Since(status.LastRun) < time.Duration(config.Interval)*time.Second {
+		return nil
+	}
+
+	// Nothing to tidy before the plugin is configured
+	org, err := loadConfig(ctx, storage)
+	if err != nil || org == nil {
+		return err
+	}
+
+	_, err = b.tidy(ctx, storage, *config)
+	return err
+}
+
+// tidy removes storage entries of projects that no longer exist, reports
+// sentry keys that are not tracked by any DSN label and deletes keys created
+// by the plugin that have not been used within the unused key period.
+func (b *backend) tidy(ctx context.Context, storage logical.Storage, opts TidyConfig) (*TidyStatus, error) {
+	if !atomic.CompareAndSwapUint32(&b.tidyRunning, 0, 1) {
+		return nil, fmt.Errorf("tidy operation is already running")
+	}
+
+	defer atomic.StoreUint32(&b.tidyRunning, 0)
+
+	config, err := loadConfig(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return nil, fmt.Errorf("plugin is not configured")
+	}
+
+	client, err := b.client(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	projects, err := storage.List(ctx, KeyProjectConfigPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &TidyStatus{
+		LastRun:        time.Now().UTC(),
+		RemovedEntries: []string{},
+		UntrackedKeys:  map[string][]string{},
+		DeletedKeys:    []string{},
+		Errors:         map[string]string{},
+	}
+
+	for _, prefix := range []string{KeyDsnPrefix, KeyMonitorPrefix, KeyCreatedKeyPrefix} {
+		removed, err := tidyOrphanedEntries(ctx, storage, prefix, projects)
+		if err != nil {
+			return nil, err
+		}
+
+		status.RemovedEntries = append(status.RemovedEntries, removed...)
+	}
+
+	for _, name := range projects {
+		project, err := loadProject(ctx, storage, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if project == nil {
+			continue
+		}
+
+		untracked, deleted, err := b.tidyProjectKeys(ctx, storage, client, config, project, opts)
+		if err != nil {
+			status.Errors[name] = err.Error()
+		}
+
+		if len(untracked) > 0 {
+			status.UntrackedKeys[name] = untracked
+		}
+
+		status.DeletedKeys = append(status.DeletedKeys, deleted...)
+	}
+
+	if len(status.RemovedEntries) > 0 {
+		b.Logger().Info("removed orphaned entries", "count", len(status.RemovedEntries))
+	}
+
+	if len(status.DeletedKeys) > 0 {
+		b.Logger().Info("deleted unused client keys", "keys", status.DeletedKeys)
+	}
+
+	entry, err := logical.StorageEntryJSON(KeyTidyStatus, status)
+	if err != nil {
+		return nil, err
+	}
+
+	err = storage.Put(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// tidyOrphanedEntries deletes the entries under prefix that belong to projects
+// that are no longer configured and returns the deleted storage keys.
+func tidyOrphanedEntries(ctx context.Context, storage logical.Storage, prefix string, projects []string) ([]string, error) {
+	dirs, err := storage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, dir := range dirs {
+		if !strings.HasSuffix(dir, "/") || strutil.StrListContains(projects, strings.TrimSuffix(dir, "/")) {
+			continue
+		}
+
+		keys, err := storage.List(ctx, prefix+dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			err = storage.Delete(ctx, prefix+dir+key)
+			if err != nil {
+				return nil, err
+			}
+
+			removed = append(removed, prefix+dir+key)
+		}
+	}
+
+	return removed, nil
+}
+
+// tidyProjectKeys returns the sentry keys of the project that are not tracked
+// by a DSN label. When enabled, untracked keys created by the plugin that were
+// not used within the unused period are deleted from sentry.
+func (b *backend) tidyProjectKeys(ctx context.Context, storage logical.Storage, client *sentry.Client, config *SentryOrg, project *SentryProject, opts TidyConfig) ([]string, []string, error) {
+	org := config.Name
+
+	var keys []clientKey
+	err := b.withProject(ctx, storage, client, config, project, func(slug string) (err error) {
+		keys, err = listClientKeys(client, sentry.Organization{Slug: &org}, sentry.Project{Slug: &slug})
+		return err
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slug := project.slug()
+
+	labels, err := storage.List(ctx, KeyDsnPrefix+project.Name+"/")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	trackedIDs, trackedLabels := map[string]bool{}, map[string]bool{}
+	for _, label := range labels {
+		dsn, err := loadDsn(ctx, storage, project.Name, label)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if dsn == nil {
+			continue
+		}
+
+		// Entries cached before key IDs were tracked are matched by label
+		if dsn.KeyID == "" {
+			trackedLabels[label] = true
+		} else {
+			trackedIDs[dsn.KeyID] = true
+		}
+	}
+
+	existing := map[string]bool{}
+	untracked, deleted := []string{}, []string{}
+	cutoff := time.Now().Add(-time.Duration(opts.UnusedKeyPeriod) * time.Second)
+
+	for _, k := range keys {
+		existing[k.ID] = true
+		if trackedIDs[k.ID] || trackedLabels[k.Label] {
+			continue
+		}
+
+		desc := fmt.Sprintf("%s (%s)", k.Label, k.ID)
+		untracked = append(untracked, desc)
+
+		if !opts.DeleteUnusedKeys {
+			continue
+		}
+
+		created, err := loadCreatedKey(ctx, storage, project.Name, k.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if created == nil || created.DateCreated.After(cutoff) {
+			continue
+		}
+
+		used, err := clientKeyUsedSince(client, org, slug, k.ID, cutoff)
+		if err != nil {
+			return untracked, deleted, fmt.Errorf("failed to check usage of key %s. %s", k.ID, err)
+		}
+
+		if used {
+			continue
+		}
+
+		err = client.DeleteClientKey(sentry.Organization{Slug: &org}, sentry.Project{Slug: &slug}, sentry.Key{ID: k.ID})
+		if err != nil && !isNotFound(err) {
+			return untracked, deleted, fmt.Errorf("failed to delete key %s. %s", k.ID, err)
+		}
+
+		err = storage.Delete(ctx, KeyCreatedKeyPrefix+project.Name+"/"+k.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		deleted = append(deleted, project.Name+"/"+desc)
+	}
+
+	// Forget keys that were removed from sentry by other means
+	ids, err := storage.List(ctx, KeyCreatedKeyPrefix+project.Name+"/")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, id := range ids {
+		if existing[id] {
+			continue
+		}
+
+		err = storage.Delete(ctx, KeyCreatedKeyPrefix+project.Name+"/"+id)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	sort.Strings(untracked)
+	return untracked, deleted, nil
+}
+
+type clientKeyStat struct {
+	Timestamp int64 `json:"ts"`
+	Total     int   `json:"total"`
+}
+
+// clientKeyUsedSince returns true if sentry received any event for the key since the given time
+func clientKeyUsedSince(client *sentry.Client, org, project, keyID string, since time.Time) (bool, error) {
+	var stats []clientKeyStat
+	err := sentryRequest(client, http.MethodGet,
+		fmt.Sprintf("projects/%s/%s/keys/%s/stats/?since=%d&resolution=1d", org, project, keyID, since.Unix()), nil, &stats)
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range stats {
+		if s.Total > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
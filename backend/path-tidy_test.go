@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHandleTidy(t *testing.T) {
+	org, project, unusedKey := "tidy-org", "tidy-app", "60120449b6b1d5e45f75561e6dabd80b"
+	keysRoute := fmt.Sprintf("/projects/%s/display-name-%s/keys/", org, project)
+
+	localSentry.handleStatic(keysRoute, http.StatusOK, getClientKeysResponseBody)
+	localSentry.handleStatic(keysRoute+unusedKey+"/stats/", http.StatusOK, `[{"ts": 1583020800, "total": 0}]`)
+	localSentry.handleMethods(keysRoute+unusedKey+"/", map[string]testResponse{
+		http.MethodDelete: {http.StatusNoContent, ""},
+	})
+
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+
+	b, err := Factory(ctx, config)
+	if err != nil {
+		t.Fatalf("failed to initialize backend factory. %s", err)
+	}
+
+	seed := map[string]interface{}{
+		KeyConfig: &SentryOrg{Name: org, Endpoint: localSentry.url, ConnectionTimeout: 10},
+		KeyProjectConfigPrefix + project: &SentryProject{
+			Name:            project,
+			DisplayName:     "display-name-" + project,
+			SentryID:        "2",
+			Slug:            "display-name-" + project,
+			DefaultDsnLabel: "primary",
+		},
+		KeyDsnPrefix + project + "/primary":          &SentryDsn{Name: "primary", KeyID: "cec9dfceb0b74c1c9a5e3c135585f364"},
+		KeyDsnPrefix + "removed-app/primary":         &SentryDsn{Name: "primary"},
+		KeyMonitorPrefix + "removed-app/backup":      &SentryMonitor{Project: "removed-app", Slug: "backup"},
+		KeyCreatedKeyPrefix + project + "/" + "gone": &CreatedKey{Project: project, KeyID: "gone"},
+		KeyCreatedKeyPrefix + project + "/" + unusedKey: &CreatedKey{
+			Project:     project,
+			Label:       "unmanaged",
+			KeyID:       unusedKey,
+			DateCreated: time.Now().Add(-48 * time.Hour),
+		},
+	}
+
+	for key, value := range seed {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := storage.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "tidy/status",
+		Storage:   storage,
+	})
+
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected error before the first tidy, got %v %v", resp, err)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "tidy",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"delete_unused_keys": true,
+			"unused_key_period":  "24h",
+		},
+	})
+
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to tidy. %v %v", resp, err)
+	}
+
+	expect := map[string]interface{}{
+		"removed_entries": []string{
+			KeyDsnPrefix + "removed-app/primary",
+			KeyMonitorPrefix + "removed-app/backup",
+		},
+		"untracked_keys": map[string][]string{
+			project: {"unmanaged (" + unusedKey + ")"},
+		},
+		"deleted_keys": []string{project + "/unmanaged (" + unusedKey + ")"},
+		"errors":       map[string]string{},
+	}
+
+	delete(resp.Data, "last_run")
+	if !cmp.Equal(expect, resp.Data) {
+		t.Fatalf("unexpected tidy result. %s", cmp.Diff(expect, resp.Data))
+	}
+
+	remaining, err := storage.List(ctx, KeyCreatedKeyPrefix+project+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(remaining) != 0 {
+		t.Errorf("expected created key records to be removed, found %v", remaining)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "tidy/status",
+		Storage:   storage,
+	})
+
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to read tidy status. %v %v", resp, err)
+	}
+
+	delete(resp.Data, "last_run")
+	if !cmp.Equal(expect, resp.Data) {
+		t.Errorf("unexpected tidy status. %s", cmp.Diff(expect, resp.Data))
+	}
+}
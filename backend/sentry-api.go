@@ -0,0 +1,115 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/atlassian/go-sentry-api"
+	"github.com/hashicorp/vault/sdk/logical"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sentryRequest performs an API call for endpoints that are not covered by
+// go-sentry-api. It uses the endpoint, token and HTTP client of the given
+// client and reports failures as sentry.APIError, same as the library does.
+func sentryRequest(client *sentry.Client, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, client.Endpoint+strings.TrimLeft(path, "/"), body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", client.AuthToken))
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := sentry.APIError{StatusCode: resp.StatusCode}
+		if err := json.Unmarshal(content, &apiErr); err != nil {
+			apiErr.Detail = string(content)
+		}
+
+		return apiErr
+	}
+
+	if out == nil || len(content) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(content, out)
+}
+
+// isNotFound returns true if the error is a 404 response from sentry
+func isNotFound(err error) bool {
+	var apiErr sentry.APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// sentryErrorResponse builds the response for a failed sentry API call. The
+// status code tells bad input apart from problems with the token or with
+// sentry itself, and the details of the sentry error are included in the
+// response data.
+func sentryErrorResponse(ctx context.Context, req *logical.Request, err error, format string, args ...interface{}) (*logical.Response, error) {
+	resp := logical.ErrorResponse("%s. %s", fmt.Sprintf(format, args...), err)
+
+	var apiErr sentry.APIError
+	if !errors.As(err, &apiErr) {
+		// Requests that did not get a response from sentry at all
+		var netErr net.Error
+		switch {
+		case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+			return logical.RespondWithStatusCode(resp, req, http.StatusGatewayTimeout)
+		case errors.As(err, &netErr):
+			return logical.RespondWithStatusCode(resp, req, http.StatusBadGateway)
+		}
+
+		return resp, nil
+	}
+
+	resp.Data["sentry_status_code"] = apiErr.StatusCode
+	resp.Data["sentry_detail"] = apiErr.Detail
+
+	code := http.StatusBadRequest
+	switch {
+	case apiErr.StatusCode == http.StatusUnauthorized, apiErr.StatusCode == http.StatusForbidden:
+		code = http.StatusForbidden
+	case apiErr.StatusCode == http.StatusNotFound:
+		code = http.StatusNotFound
+	case apiErr.StatusCode == http.StatusTooManyRequests:
+		code = http.StatusTooManyRequests
+		if op, ok := ctx.Value(operationKey{}).(*sentryOperation); ok && op.stats.retryHint() > 0 {
+			resp.Data["retry_after"] = int(op.stats.retryHint().Round(time.Second).Seconds())
+		}
+	case apiErr.StatusCode >= 500:
+		code = http.StatusBadGateway
+	}
+
+	return logical.RespondWithStatusCode(resp, req, code)
+}
@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/atlassian/go-sentry-api"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSentryErrorResponse(t *testing.T) {
+	cases := map[int]int{
+		http.StatusBadRequest:          http.StatusBadRequest,
+		http.StatusUnauthorized:        http.StatusForbidden,
+		http.StatusForbidden:           http.StatusForbidden,
+		http.StatusNotFound:            http.StatusNotFound,
+		http.StatusTooManyRequests:     http.StatusTooManyRequests,
+		http.StatusInternalServerError: http.StatusBadGateway,
+		http.StatusServiceUnavailable:  http.StatusBadGateway,
+	}
+
+	op := new(sentryOperation)
+	op.stats.retryAfter = 30 * time.Second
+	ctx := context.WithValue(context.Background(), operationKey{}, op)
+
+	for sentryCode, expect := range cases {
+		err := fmt.Errorf("wrapped. %w", sentry.APIError{StatusCode: sentryCode, Detail: "detail"})
+
+		resp, _ := sentryErrorResponse(ctx, &logical.Request{}, err, "failed to call %s", "sentry")
+		if err := testSentryError(resp, expect, "failed to call sentry. wrapped"); err != nil {
+			t.Errorf("unexpected response for sentry status %d. %s", sentryCode, err)
+			continue
+		}
+
+		body := resp.Data[logical.HTTPRawBody].(string)
+		if !strings.Contains(body, fmt.Sprintf(`"sentry_status_code":%d`, sentryCode)) {
+			t.Errorf("missing sentry status code in %s", body)
+		}
+
+		if hint := strings.Contains(body, `"retry_after":30`); hint != (sentryCode == http.StatusTooManyRequests) {
+			t.Errorf("unexpected retry hint for sentry status %d in %s", sentryCode, body)
+		}
+	}
+
+	resp, _ := sentryErrorResponse(ctx, &logical.Request{}, context.DeadlineExceeded, "failed to call sentry")
+	if err := testSentryError(resp, http.StatusGatewayTimeout, "failed to call sentry"); err != nil {
+		t.Errorf("unexpected response for timeout. %s", err)
+	}
+
+	resp, _ = sentryErrorResponse(ctx, &logical.Request{}, errors.New("quota reached"), "failed to call sentry")
+	if !resp.IsError() || resp.Error().Error() != "failed to call sentry. quota reached" {
+		t.Errorf("expected plain error response for errors that did not come from sentry, got %v", resp)
+	}
+}
@@ -0,0 +1,502 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/atlassian/go-sentry-api"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/time/rate"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+
+	rollbackTimeout = 30 * time.Second
+)
+
+// client returns a sentry client for the configuration. The client is cached
+// on the backend and shares its connections and rate limit with every request
+// of the mount. Its calls are bound to ctx and, within an operation, to the
+// operation deadline. Delays and retries are recorded on the operation so they
+// can be reported back to the caller.
+func (b *backend) client(ctx context.Context, config *SentryOrg) (*sentry.Client, error) {
+	client, err := b.cachedClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return scopedClient(ctx, client, config), nil
+}
+
+// uncachedClient returns a sentry client for a configuration that is not
+// stored yet. It has its own connections and rate limit and leaves the
+// cached client of the mount untouched. The returned function releases
+// its connections.
+func uncachedClient(ctx context.Context, config *SentryOrg) (*sentry.Client, func(), error) {
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := newClient(config, transport, newLimiter(config))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return scopedClient(ctx, client, config), transport.CloseIdleConnections, nil
+}
+
+// scopedClient returns a copy of the client whose calls are bound to ctx
+func scopedClient(ctx context.Context, client *sentry.Client, config *SentryOrg) *sentry.Client {
+	transport := *client.HTTPClient.Transport.(*throttledTransport)
+	transport.ctx = ctx
+
+	if op, ok := ctx.Value(operationKey{}).(*sentryOperation); ok {
+		transport.ctx = op.context(ctx, time.Duration(config.OperationTimeout)*time.Second)
+		transport.stats = &op.stats
+	}
+
+	scoped := *client
+	scoped.HTTPClient = &http.Client{
+		Timeout:   client.HTTPClient.Timeout,
+		Transport: &transport,
+	}
+
+	return &scoped
+}
+
+// rollback removes a sentry resource that was created by an operation which
+// failed afterwards, so that no half-created resource is left behind. It uses
+// a fresh context because the context of the operation may be cancelled.
+func (b *backend) rollback(config *SentryOrg, resource string, undo func(client *sentry.Client) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	client, err := b.client(ctx, config)
+	if err == nil {
+		err = undo(client)
+	}
+
+	if err != nil && !isNotFound(err) {
+		b.Logger().Error("failed to roll back partially created resource", "resource", resource, "error", err)
+		return
+	}
+
+	b.Logger().Info("rolled back partially created resource", "resource", resource)
+}
+
+// cachedClient returns the cached client, building a new one when
+// there is none or when it was built for a different configuration.
+// The rate limiter is kept unless the rate limit settings changed, so
+// that changing other settings does not reset the rate limit.
+func (b *backend) cachedClient(config *SentryOrg) (*sentry.Client, error) {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	if b.sentryClient != nil && b.clientConfig == *config {
+		return b.sentryClient, nil
+	}
+
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter := b.limiter
+	if limiter == nil || b.clientConfig.RateLimit != config.RateLimit || b.clientConfig.RateLimitBurst != config.RateLimitBurst {
+		limiter = newLimiter(config)
+	}
+
+	client, err := newClient(config, transport, limiter)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.transport != nil {
+		b.transport.CloseIdleConnections()
+	}
+
+	b.transport = transport
+	b.limiter = limiter
+	b.sentryClient = client
+	b.clientConfig = *config
+
+	return client, nil
+}
+
+// newClient builds a sentry client for the configuration that sends its
+// requests through the transport, throttled by the limiter.
+func newClient(config *SentryOrg, transport http.RoundTripper, limiter *rate.Limiter) (*sentry.Client, error) {
+	client, err := config.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	client.HTTPClient.Transport = &throttledTransport{
+		base:       transport,
+		limiter:    limiter,
+		maxRetries: config.MaxRetries,
+		baseDelay:  retryBaseDelay,
+		maxDelay:   retryMaxDelay,
+	}
+
+	return client, nil
+}
+
+// newLimiter builds the rate limiter of the configuration
+func newLimiter(config *SentryOrg) *rate.Limiter {
+	limit, burst := rate.Inf, 1
+	if config.RateLimit > 0 {
+		limit = rate.Limit(config.RateLimit)
+		if config.RateLimitBurst > 1 {
+			burst = config.RateLimitBurst
+		}
+	}
+
+	return rate.NewLimiter(limit, burst)
+}
+
+// tlsVersions maps the accepted values of tls_min_version to their versions
+var tlsVersions = map[string]uint16{
+	"tls10": tls.VersionTLS10,
+	"tls11": tls.VersionTLS11,
+	"tls12": tls.VersionTLS12,
+	"tls13": tls.VersionTLS13,
+}
+
+// newTransport builds the HTTP transport for the sentry endpoint with the
+// CA bundle, client certificate, proxy and TLS version of the configuration.
+func newTransport(config *SentryOrg) (*http.Transport, error) {
+	minVersion := "tls12"
+	if config.TLSMinVersion != "" {
+		minVersion = config.TLSMinVersion
+	}
+
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls_min_version %q", config.TLSMinVersion)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: version}
+
+	if config.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(config.CACert)) {
+			return nil, fmt.Errorf("ca_cert does not contain a PEM encoded certificate")
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if (config.ClientCert == "") != (config.ClientKey == "") {
+		return nil, fmt.Errorf("client_cert and client_key must be set together")
+	}
+
+	if config.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(config.ClientCert), []byte(config.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate. %s", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	if config.ProxyURL != "" {
+		proxy, err := url.Parse(config.ProxyURL)
+		if err != nil || (proxy.Scheme != "http" && proxy.Scheme != "https") || proxy.Host == "" {
+			return nil, fmt.Errorf("proxy_url must be an http or https URL")
+		}
+
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return transport, nil
+}
+
+// redactURL hides the password of a URL so that it can be returned to clients
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "redacted")
+	}
+
+	return u.String()
+}
+
+// resetClient drops the cached client so that the next request builds
+// one from the current configuration.
+func (b *backend) resetClient() {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	b.sentryClient = nil
+	if b.transport != nil {
+		b.transport.CloseIdleConnections()
+	}
+}
+
+type operationKey struct{}
+
+// sentryOperation is the state shared by the sentry API calls made while
+// serving a single request.
+type sentryOperation struct {
+	stats  throttleStats
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// context returns the context of the sentry calls of the operation. The
+// operation deadline starts with the first call and covers all calls after it.
+func (o *sentryOperation) context(parent context.Context, timeout time.Duration) context.Context {
+	o.once.Do(func() {
+		if timeout > 0 {
+			o.ctx, o.cancel = context.WithTimeout(parent, timeout)
+		} else {
+			o.ctx, o.cancel = context.WithCancel(parent)
+		}
+	})
+
+	return o.ctx
+}
+
+func (o *sentryOperation) done() {
+	if o.cancel != nil {
+		o.cancel()
+	}
+}
+
+// throttleStats records how much a request was slowed down by the rate
+// limit and by retries of throttled or failed sentry API calls.
+type throttleStats struct {
+	sync.Mutex
+	delay   time.Duration
+	retries int
+
+	// retryAfter is the delay sentry asked for when a request was
+	// still rate limited after the retries were exhausted
+	retryAfter time.Duration
+}
+
+func (s *throttleStats) record(delay time.Duration, retry bool) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.delay += delay
+	if retry {
+		s.retries++
+	}
+}
+
+// giveUp records the retry hint of a rate limited response that is returned to the caller
+func (s *throttleStats) giveUp(resp *http.Response, delay time.Duration) {
+	if s == nil || resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.retryAfter = delay
+}
+
+func (s *throttleStats) retryHint() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.retryAfter
+}
+
+func (s *throttleStats) warning() string {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.delay <= 0 && s.retries == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("sentry API requests were delayed by %s and retried %d times due to rate limiting or server errors", s.delay.Round(time.Millisecond), s.retries)
+}
+
+// trackOperation wraps an operation callback so that its sentry calls share
+// the operation deadline, and so that the response carries a warning when
+// those calls were delayed.
+func trackOperation(callback framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		op := new(sentryOperation)
+		resp, err := callback(context.WithValue(ctx, operationKey{}, op), req, data)
+		op.done()
+
+		if warning := op.stats.warning(); warning != "" && resp != nil {
+			resp.AddWarning(warning)
+		}
+
+		return resp, err
+	}
+}
+
+// throttledTransport limits the rate of requests sent to sentry and retries
+// requests that were rejected with 429, or idempotent requests that failed
+// with a 5xx status, using exponential backoff with jitter and honoring the
+// Retry-After header.
+type throttledTransport struct {
+	base       http.RoundTripper
+	limiter    *rate.Limiter
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	stats      *throttleStats
+
+	// ctx replaces the context of requests built by go-sentry-api,
+	// which does not accept one.
+	ctx context.Context
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if t.ctx != nil {
+		ctx = t.ctx
+	}
+
+	// go-sentry-api closes the connection after every request, which
+	// defeats the connection pool of the shared transport.
+	req = req.Clone(ctx)
+	req.Close = false
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, fmt.Errorf("request body can not be replayed for retry")
+			}
+
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+
+			req.Body = body
+		}
+
+		err := t.wait(req.Context(), t.limiter.Reserve().Delay(), false)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || !retryable(req.Method, resp.StatusCode) {
+			return resp, err
+		}
+
+		delay, ok := t.retryDelay(resp, attempt)
+		if !ok || attempt >= t.maxRetries {
+			t.stats.giveUp(resp, delay)
+			return resp, nil
+		}
+
+		resp.Body.Close()
+
+		err = t.wait(req.Context(), delay, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait sleeps for the delay unless the context is done first
+func (t *throttledTransport) wait(ctx context.Context, delay time.Duration, retry bool) error {
+	t.stats.record(delay, retry)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryDelay returns the delay before the next attempt. Retry-After is used
+// when sentry sends it, unless it exceeds the maximum delay, in which case
+// the response is returned to the caller as is.
+func (t *throttledTransport) retryDelay(resp *http.Response, attempt int) (time.Duration, bool) {
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		delay, ok := parseRetryAfter(value)
+		if ok {
+			return delay, delay <= t.maxDelay
+		}
+	}
+
+	delay := t.baseDelay << uint(attempt)
+	if delay <= 0 || delay > t.maxDelay {
+		delay = t.maxDelay
+	}
+
+	// Jitter over the upper half keeps retries of concurrent requests apart
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1)), true
+}
+
+// retryable returns true if a request may be sent again after the response.
+// Rate limited requests were not processed by sentry. A request that failed
+// with a server error may have been processed anyway, so it is only retried
+// when repeating it can not create a second resource.
+func retryable(method string, code int) bool {
+	if code == http.StatusTooManyRequests {
+		return true
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return code >= 500
+	}
+
+	return false
+}
+
+// parseRetryAfter parses the header as seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			seconds = 0
+		}
+
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		delay := time.Until(at)
+		if delay < 0 {
+			delay = 0
+		}
+
+		return delay, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/atlassian/go-sentry-api"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// tokenFeature is a feature of the plugin along with the
+// scopes the sentry API token needs for it.
+type tokenFeature struct {
+	name     string
+	scopes   []string
+	required bool
+}
+
+// tokenFeatures lists the features of the plugin. Without the scopes of the
+// required features the plugin can not manage projects and their DSN at all.
+var tokenFeatures = []tokenFeature{
+	{name: "organization lookup", scopes: []string{"org:read"}, required: true},
+	{name: "project management", scopes: []string{"project:write", "team:read"}, required: true},
+	{name: "DSN management", scopes: []string{"project:write"}, required: true},
+	{name: "rollback of created projects", scopes: []string{"project:admin"}},
+	{name: "integrations", scopes: []string{"org:write"}},
+}
+
+// scopeLevels orders the access levels of a resource. A scope grants
+// every lower level of the same resource, so project:admin implies
+// project:write and project:read.
+var scopeLevels = map[string]int{
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
+// sentryAuth is the description of the token returned by the API root
+type sentryAuth struct {
+	Auth *struct {
+		Scopes []string `json:"scopes"`
+	} `json:"auth"`
+}
+
+// tokenScopes returns the scopes of the token of the client. The second
+// value is false when sentry does not report them, which is the case for
+// old self-hosted installations.
+func tokenScopes(client *sentry.Client) ([]string, bool, error) {
+	var root sentryAuth
+	err := sentryRequest(client, http.MethodGet, "", nil, &root)
+	if isNotFound(err) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if root.Auth == nil {
+		return nil, false, nil
+	}
+
+	return root.Auth.Scopes, true, nil
+}
+
+// hasScope returns true if one of the scopes grants the wanted scope
+func hasScope(scopes []string, want string) bool {
+	wantResource, wantLevel := splitScope(want)
+	for _, scope := range scopes {
+		resource, level := splitScope(scope)
+		if resource == wantResource && level >= wantLevel {
+			return true
+		}
+	}
+
+	return false
+}
+
+func splitScope(scope string) (string, int) {
+	parts := strings.SplitN(scope, ":", 2)
+	if len(parts) != 2 {
+		return scope, 0
+	}
+
+	return parts[0], scopeLevels[parts[1]]
+}
+
+// unavailableFeatures returns the features that can not be used with the
+// scopes, and whether any of them is required. Each feature is described
+// along with the scopes it misses.
+func unavailableFeatures(scopes []string) ([]string, bool) {
+	var unavailable []string
+	required := false
+
+	for _, feature := range tokenFeatures {
+		var missing []string
+		for _, scope := range feature.scopes {
+			if !hasScope(scopes, scope) {
+				missing = append(missing, scope)
+			}
+		}
+
+		if len(missing) == 0 {
+			continue
+		}
+
+		sort.Strings(missing)
+		unavailable = append(unavailable, fmt.Sprintf("%s (missing %s)", feature.name, strings.Join(missing, ", ")))
+		required = required || feature.required
+	}
+
+	return unavailable, required
+}